@@ -0,0 +1,10 @@
+// Command es inspects the events of an event store. Event data is decoded
+// with the types in the proto registry only, services should build their own
+// tool registering their types and apply functions with package inspect
+package main
+
+import "github.com/aukbit/pluto-event-source/inspect"
+
+func main() {
+	inspect.Main()
+}
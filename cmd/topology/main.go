@@ -0,0 +1,105 @@
+// Command topology lists and converges the Cloud PubSub topics and
+// subscriptions of an environment to a manifest. Set PUBSUB_EMULATOR_HOST to
+// run it against the PubSub emulator.
+//
+//	topology -env development list
+//	topology -env development -manifest topology.json plan
+//	topology -env development -manifest topology.json [-prune] apply
+//	topology -env development -manifest topology.json orphans
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	context "golang.org/x/net/context"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/aukbit/pluto-event-source/topology"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "topology: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	project := flag.String("project", os.Getenv("GCP_PROJECT"), "GCP project id")
+	env := flag.String("env", os.Getenv("GCP_PROJECT_ENV"), "environment prefix of topics and subscriptions")
+	manifest := flag.String("manifest", "", "json manifest of the services topics")
+	prune := flag.Bool("prune", false, "delete topics and subscriptions not declared in the manifest")
+	asJSON := flag.Bool("json", false, "print json")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: topology [flags] list|plan|apply|orphans")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || *project == "" || *env == "" {
+		flag.Usage()
+		return flag.ErrHelp
+	}
+	ctx := context.Background()
+	client, err := pubsub.NewClient(ctx, *project)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	st, err := topology.Current(ctx, client, *env)
+	if err != nil {
+		return err
+	}
+	cmd := flag.Arg(0)
+	if cmd == "list" {
+		return output(st, *asJSON, func() {
+			for _, t := range st.Topics {
+				fmt.Printf("topic %s labels %v\n", t.Name, t.Labels)
+			}
+			for _, s := range st.Subscriptions {
+				fmt.Printf("subscription %s topic %s ack deadline %v labels %v\n", s.Name, s.Topic, s.AckDeadline, s.Labels)
+			}
+		})
+	}
+	if *manifest == "" {
+		return fmt.Errorf("%s: -manifest is required", cmd)
+	}
+	m, err := topology.ReadManifest(*manifest)
+	if err != nil {
+		return err
+	}
+	var changes []topology.Change
+	switch cmd {
+	case "plan", "apply":
+		changes = topology.Plan(m, st, *prune)
+	case "orphans":
+		changes = topology.Orphans(m, st)
+	default:
+		flag.Usage()
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	if err := output(changes, *asJSON, func() {
+		for _, c := range changes {
+			fmt.Println(c)
+		}
+	}); err != nil {
+		return err
+	}
+	if cmd != "apply" {
+		return nil
+	}
+	return topology.Apply(ctx, client, *env, changes)
+}
+
+// output prints v as json or with the text function
+func output(v interface{}, asJSON bool, text func()) error {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	text()
+	return nil
+}
@@ -0,0 +1,94 @@
+package eventstore
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// filter holds the query params understood by the event store
+type filter struct {
+	id                     string
+	lowest, highest        int64
+	after                  int64
+	topics                 map[string]bool
+	schema                 string
+	createdFrom, createdTo time.Time
+	limit                  int
+}
+
+func newFilter(params map[string]string) (f filter, err error) {
+	f.id = params[store.AggregatorIDQueryKey]
+	f.schema = params[store.SchemaQueryKey]
+	for k, v := range map[string]*int64{
+		store.LowestVersionQueryKey:  &f.lowest,
+		store.HighestVersionQueryKey: &f.highest,
+		store.SequenceQueryKey:       &f.after,
+	} {
+		if params[k] == "" {
+			continue
+		}
+		if *v, err = strconv.ParseInt(params[k], 10, 64); err != nil {
+			return f, err
+		}
+	}
+	for k, v := range map[string]*time.Time{
+		store.CreatedFromQueryKey: &f.createdFrom,
+		store.CreatedToQueryKey:   &f.createdTo,
+	} {
+		if params[k] == "" {
+			continue
+		}
+		if *v, err = time.Parse(time.RFC3339Nano, params[k]); err != nil {
+			return f, err
+		}
+	}
+	if params[store.LimitQueryKey] != "" {
+		if f.limit, err = strconv.Atoi(params[store.LimitQueryKey]); err != nil {
+			return f, err
+		}
+	}
+	if params[store.TopicQueryKey] != "" {
+		f.topics = make(map[string]bool)
+		for _, t := range strings.Split(params[store.TopicQueryKey], ",") {
+			f.topics[t] = true
+		}
+	}
+	return f, nil
+}
+
+func (f filter) match(e *pb.Event) bool {
+	a := e.GetAggregate()
+	if f.id != "" && a.GetId() != f.id {
+		return false
+	}
+	if f.lowest != 0 && a.GetVersion() < f.lowest {
+		return false
+	}
+	if f.highest != 0 && a.GetVersion() > f.highest {
+		return false
+	}
+	if f.after != 0 {
+		if seq, _ := strconv.ParseInt(e.Metadata[store.SequenceMetadataKey], 10, 64); seq <= f.after {
+			return false
+		}
+	}
+	if f.topics != nil && !f.topics[e.GetTopic()] {
+		return false
+	}
+	if f.schema != "" && a.GetSchema() != f.schema {
+		return false
+	}
+	created, _ := ptypes.Timestamp(e.GetCreated())
+	if !f.createdFrom.IsZero() && created.Before(f.createdFrom) {
+		return false
+	}
+	if !f.createdTo.IsZero() && created.After(f.createdTo) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,260 @@
+package eventstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// recordHeaderSize length and crc32 of the record data
+	recordHeaderSize = 8
+	// maxRecordSize maximum length of the record data
+	maxRecordSize = 16 << 20
+)
+
+var (
+	errCorruptRecord  = errors.New("corrupt record")
+	errTornRecord     = errors.New("torn record")
+	errRecordTooLarge = errors.New("record too large")
+)
+
+// Log is an append-only log of records
+type Log interface {
+	// Append writes the record at the end of the log and returns its offset
+	Append(data []byte) (int64, error)
+	// ReadAt reads the record at the offset
+	ReadAt(offset int64) ([]byte, error)
+	// Replay calls fn for every record in the log, in append order
+	Replay(fn func(offset int64, data []byte) error) error
+	Close() error
+}
+
+// -----------------------------------------------------------------------------
+
+// FileLog is a log stored in a local file. Every record is written with its
+// length and crc32, and synced before Append returns
+type FileLog struct {
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenFileLog opens or creates the log file. A record partially written at
+// the end of the file, e.g. on a crash, is truncated. Any other corrupt record
+// is returned as an error, the file being left as it is
+func OpenFileLog(path string) (*FileLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := &FileLog{f: f}
+	var end int64
+	err = l.Replay(func(offset int64, data []byte) error {
+		end = offset + recordHeaderSize + int64(len(data))
+		return nil
+	})
+	if err != nil && errors.Cause(err) != errTornRecord {
+		f.Close()
+		return nil, errors.Wrap(err, path)
+	}
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.size = end
+	return l, nil
+}
+
+// Append implements Log
+func (l *FileLog) Append(data []byte) (int64, error) {
+	if len(data) > maxRecordSize {
+		return 0, errRecordTooLarge
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	buf := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	copy(buf[recordHeaderSize:], data)
+	offset := l.size
+	if _, err := l.f.WriteAt(buf, offset); err != nil {
+		return 0, err
+	}
+	if err := l.f.Sync(); err != nil {
+		return 0, err
+	}
+	l.size += int64(len(buf))
+	return offset, nil
+}
+
+// ReadAt implements Log
+func (l *FileLog) ReadAt(offset int64) ([]byte, error) {
+	l.mu.Lock()
+	size := l.size
+	l.mu.Unlock()
+	if offset < 0 || offset >= size {
+		return nil, errCorruptRecord
+	}
+	data, err := readRecord(io.NewSectionReader(l.f, offset, size-offset), size-offset)
+	if err == errTornRecord {
+		return nil, errCorruptRecord
+	}
+	return data, err
+}
+
+// Replay implements Log. It returns errTornRecord at a last record partially
+// written, and errCorruptRecord at any other record not matching its crc32
+// or length, both with the offset of the record. A record is only the last one
+// if no valid record is found after its header
+func (l *FileLog) Replay(fn func(offset int64, data []byte) error) error {
+	fi, err := l.f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	r := bufio.NewReader(io.NewSectionReader(l.f, 0, size))
+	var offset int64
+	for {
+		data, err := readRecord(r, size-offset)
+		if err == io.EOF {
+			return nil
+		}
+		if err == errTornRecord {
+			// a record followed by a valid one was not the last written
+			followed, ferr := followedByRecord(l.f, offset+recordHeaderSize, size)
+			if ferr != nil {
+				err = ferr
+			} else if followed {
+				err = errCorruptRecord
+			}
+		}
+		if err != nil {
+			return errors.Wrapf(err, "offset %d", offset)
+		}
+		if err := fn(offset, data); err != nil {
+			return err
+		}
+		offset += recordHeaderSize + int64(len(data))
+	}
+}
+
+// Close implements Log
+func (l *FileLog) Close() error {
+	return l.f.Close()
+}
+
+// readRecord reads the record at the start of the remaining bytes of the log.
+// Records not fully written before the end of the log, or ending at it with a
+// crc32 not matching, may be torn if they are the last one. As a record is
+// written at once, a record exceeding the end of the log by more than the
+// largest record is not the last one, its length is corrupt
+func readRecord(r io.Reader, remaining int64) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errTornRecord
+		}
+		return nil, err
+	}
+	n := int64(binary.BigEndian.Uint32(header[0:4]))
+	last := remaining <= recordHeaderSize+maxRecordSize
+	if recordHeaderSize+n > remaining {
+		if last {
+			return nil, errTornRecord
+		}
+		return nil, errCorruptRecord
+	}
+	if n > maxRecordSize {
+		return nil, errCorruptRecord
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		if recordHeaderSize+n == remaining {
+			return nil, errTornRecord
+		}
+		return nil, errCorruptRecord
+	}
+	return data, nil
+}
+
+// followedByRecord reports if a valid record starts anywhere between from and
+// the end of the log. It is only called at a record that may be torn, at most
+// the largest record away from the end
+func followedByRecord(r io.ReaderAt, from, end int64) (bool, error) {
+	if from >= end {
+		return false, nil
+	}
+	buf := make([]byte, end-from)
+	if _, err := r.ReadAt(buf, from); err != nil && err != io.EOF {
+		return false, err
+	}
+	for p := 0; p+recordHeaderSize < len(buf); p++ {
+		n := int(binary.BigEndian.Uint32(buf[p : p+4]))
+		if n == 0 || n > len(buf)-p-recordHeaderSize {
+			continue
+		}
+		data := buf[p+recordHeaderSize : p+recordHeaderSize+n]
+		if crc32.ChecksumIEEE(data) == binary.BigEndian.Uint32(buf[p+4:p+8]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// MemoryLog is a log kept in memory, offsets being the record positions
+type MemoryLog struct {
+	mu      sync.RWMutex
+	records [][]byte
+}
+
+// NewMemoryLog returns an empty in-memory log
+func NewMemoryLog() *MemoryLog {
+	return &MemoryLog{}
+}
+
+// Append implements Log
+func (l *MemoryLog) Append(data []byte) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, append([]byte(nil), data...))
+	return int64(len(l.records) - 1), nil
+}
+
+// ReadAt implements Log
+func (l *MemoryLog) ReadAt(offset int64) ([]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if offset < 0 || offset >= int64(len(l.records)) {
+		return nil, errCorruptRecord
+	}
+	return l.records[offset], nil
+}
+
+// Replay implements Log
+func (l *MemoryLog) Replay(fn func(offset int64, data []byte) error) error {
+	l.mu.RLock()
+	records := l.records
+	l.mu.RUnlock()
+	for i, data := range records {
+		if err := fn(int64(i), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close implements Log
+func (l *MemoryLog) Close() error {
+	return nil
+}
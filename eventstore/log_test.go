@@ -0,0 +1,158 @@
+package eventstore
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// openLog opens a file log in a temporary directory with the records appended
+func openLog(t *testing.T, records ...string) (*FileLog, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "eventstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "events.log")
+	l, err := OpenFileLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range records {
+		if _, err := l.Append([]byte(r)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return l, path
+}
+
+// records returns the records replayed from the log
+func records(t *testing.T, l Log) []string {
+	t.Helper()
+	var out []string
+	if err := l.Replay(func(offset int64, data []byte) error {
+		out = append(out, string(data))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// writeAt overwrites the log file at the offset, or appends when negative
+func writeAt(t *testing.T, path string, offset int64, b []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if offset < 0 {
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset = fi.Size()
+	}
+	if _, err := f.WriteAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func header(length uint32, crc uint32) []byte {
+	b := make([]byte, recordHeaderSize)
+	binary.BigEndian.PutUint32(b[0:4], length)
+	binary.BigEndian.PutUint32(b[4:8], crc)
+	return b
+}
+
+func TestFileLogReopen(t *testing.T) {
+	l, path := openLog(t, "a", "bb", "ccc")
+	defer os.RemoveAll(filepath.Dir(path))
+	l.Close()
+	l, err := OpenFileLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if got := records(t, l); len(got) != 3 || got[2] != "ccc" {
+		t.Fatalf("expected records reopened got %v", got)
+	}
+	data, err := l.ReadAt(recordHeaderSize + 1)
+	if err != nil || string(data) != "bb" {
+		t.Fatalf("expected record bb got %q, %v", data, err)
+	}
+}
+
+func TestFileLogTruncatesTornRecord(t *testing.T) {
+	full := append(header(5, 0), []byte("torn!")...)
+	for name, tail := range map[string][]byte{
+		"header":   header(5, 0)[:3],
+		"data":     full[:recordHeaderSize+2],
+		"crc":      full,
+		"oversize": header(0xffffffff, 0),
+	} {
+		l, path := openLog(t, "a", "bb")
+		l.Close()
+		writeAt(t, path, -1, tail)
+		l, err := OpenFileLog(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := records(t, l); len(got) != 2 {
+			t.Fatalf("%s: expected torn record truncated got %q", name, got)
+		}
+		// records appended after the truncation are read back
+		if _, err := l.Append([]byte("c")); err != nil {
+			t.Fatal(err)
+		}
+		if got := records(t, l); len(got) != 3 || got[2] != "c" {
+			t.Fatalf("%s: expected record appended after truncation got %q", name, got)
+		}
+		l.Close()
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
+
+func TestFileLogCorruptRecord(t *testing.T) {
+	second := int64(recordHeaderSize + 1)
+	for _, tc := range []struct {
+		name   string
+		offset int64
+		b      []byte
+	}{
+		{"data", second + recordHeaderSize, []byte("x")},
+		// lengths of the second record past or at the end of the log, the
+		// third record following it
+		{"length past end", second, header(0xffff, 0)[:4]},
+		{"length at end", second, header(2+recordHeaderSize+3, 0)[:4]},
+	} {
+		l, path := openLog(t, "a", "bb", "ccc")
+		l.Close()
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeAt(t, path, tc.offset, tc.b)
+		if _, err := OpenFileLog(path); errors.Cause(err) != errCorruptRecord {
+			t.Fatalf("%s: expected %v got %v", tc.name, errCorruptRecord, err)
+		}
+		if after, err := os.Stat(path); err != nil || after.Size() != fi.Size() {
+			t.Fatalf("%s: expected log file with corrupt record not truncated", tc.name)
+		}
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
+
+func TestFileLogRecordTooLarge(t *testing.T) {
+	l, path := openLog(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer l.Close()
+	if _, err := l.Append(make([]byte, maxRecordSize+1)); err != errRecordTooLarge {
+		t.Fatalf("expected %v got %v", errRecordTooLarge, err)
+	}
+}
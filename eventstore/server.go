@@ -0,0 +1,334 @@
+// Package eventstore is a reference event store implementing the
+// EventSourceCommand and EventSourceProjection services, with the query params
+// and metadata used by the store package. Events and snapshots are appended to
+// logs, either local files or memory, and indexed by aggregate and sequence.
+//
+//	es, err := eventstore.Open("/var/lib/events")
+//	if err != nil {
+//		return err
+//	}
+//	defer es.Close()
+//	s := pluto.New(
+//		pluto.Servers(eventstore.NewEventStoreServer(":65060", es)),
+//		pluto.Clients(store.NewEventSourceCommandClient("127.0.0.1:65060")),
+//		pluto.Clients(store.NewEventSourceQueryClient("127.0.0.1:65060")),
+//	)
+package eventstore
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/aukbit/pluto/server"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ServerName constant to be used as name of the pluto event store server
+	ServerName string = "event_store"
+
+	eventsFileName    = "events.log"
+	snapshotsFileName = "snapshots.log"
+)
+
+var (
+	errSnapshotNotFound = status.Error(codes.NotFound, "snapshot not found")
+)
+
+// Server is an event store. Versions of an aggregate are unique, events
+// created with a version other than the current version of the aggregate are
+// rejected with codes.Aborted
+type Server struct {
+	mu        sync.RWMutex
+	events    Log
+	snapshots Log
+	// sequence holds the offsets of events by sequence - 1
+	sequence []int64
+	// aggregates holds the offsets of the events of each aggregate by version - 1
+	aggregates map[string][]int64
+	// snaps holds the offsets of the snapshots of each aggregate
+	snaps map[string][]int64
+}
+
+// New returns an event store on the logs, replaying them to build its indexes
+func New(events, snapshots Log) (*Server, error) {
+	s := &Server{
+		events:     events,
+		snapshots:  snapshots,
+		aggregates: make(map[string][]int64),
+		snaps:      make(map[string][]int64),
+	}
+	err := events.Replay(func(offset int64, data []byte) error {
+		e := &pb.Event{}
+		if err := proto.Unmarshal(data, e); err != nil {
+			return errors.Wrapf(err, "event at offset %d", offset)
+		}
+		s.index(offset, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = snapshots.Replay(func(offset int64, data []byte) error {
+		e := &pb.Event{}
+		if err := proto.Unmarshal(data, e); err != nil {
+			return errors.Wrapf(err, "snapshot at offset %d", offset)
+		}
+		id := e.GetAggregate().GetId()
+		s.snaps[id] = append(s.snaps[id], offset)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Open returns an event store with its logs in the directory, creating it if
+// it does not exist
+func Open(dir string) (*Server, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	events, err := OpenFileLog(filepath.Join(dir, eventsFileName))
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := OpenFileLog(filepath.Join(dir, snapshotsFileName))
+	if err != nil {
+		events.Close()
+		return nil, err
+	}
+	s, err := New(events, snapshots)
+	if err != nil {
+		events.Close()
+		snapshots.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewMemory returns an empty event store kept in memory
+func NewMemory() *Server {
+	s, _ := New(NewMemoryLog(), NewMemoryLog())
+	return s
+}
+
+// Close closes the logs
+func (s *Server) Close() error {
+	if err := s.events.Close(); err != nil {
+		return err
+	}
+	return s.snapshots.Close()
+}
+
+// Register registers the command and projection services on the grpc server
+func (s *Server) Register(g *grpc.Server) {
+	pb.RegisterEventSourceCommandServer(g, s)
+	pb.RegisterEventSourceProjectionServer(g, s)
+}
+
+// NewEventStoreServer returns a pluto grpc server serving the event store
+func NewEventStoreServer(addr string, es *Server) *server.Server {
+	return server.New(
+		server.Name(ServerName),
+		server.Addr(addr),
+		server.GRPCRegister(es.Register),
+		server.UnaryServerInterceptors(store.EventIDUnaryServerInterceptor()),
+		server.StreamServerInterceptors(store.EventIDStreamServerInterceptor()),
+	)
+}
+
+// Create appends the event if it was dispatched with the current version of
+// the aggregate, assigning it the version following it and the next sequence
+func (s *Server) Create(ctx context.Context, e *pb.Event) (*pb.Ack, error) {
+	if e.GetAggregate() == nil {
+		return nil, status.Error(codes.InvalidArgument, store.ErrEventWithoutAggregate.Error())
+	}
+	if e.Aggregate.GetId() == "" {
+		return nil, status.Error(codes.InvalidArgument, store.ErrInvalidAggregateId.Error())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := e.Aggregate.GetId()
+	version := int64(len(s.aggregates[id]))
+	if e.Aggregate.GetVersion() != version {
+		return nil, store.ErrConcurrencyException
+	}
+	e = proto.Clone(e).(*pb.Event)
+	e.Aggregate.Version = version + 1
+	if e.Metadata == nil {
+		e.Metadata = make(map[string]string)
+	}
+	e.Metadata[store.SequenceMetadataKey] = strconv.Itoa(len(s.sequence) + 1)
+	if e.Created == nil {
+		e.Created = ptypes.TimestampNow()
+	}
+	data, err := proto.Marshal(e)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	offset, err := s.events.Append(data)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	s.index(offset, e)
+	return &pb.Ack{Ok: true}, nil
+}
+
+// Snap appends the snapshot of the aggregate
+func (s *Server) Snap(ctx context.Context, e *pb.Event) (*pb.Ack, error) {
+	if e.GetAggregate().GetId() == "" {
+		return nil, status.Error(codes.InvalidArgument, store.ErrInvalidAggregateId.Error())
+	}
+	e = proto.Clone(e).(*pb.Event)
+	if e.Created == nil {
+		e.Created = ptypes.TimestampNow()
+	}
+	data, err := proto.Marshal(e)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offset, err := s.snapshots.Append(data)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	id := e.Aggregate.GetId()
+	s.snaps[id] = append(s.snaps[id], offset)
+	return &pb.Ack{Ok: true}, nil
+}
+
+// Get returns the latest snapshot of the aggregate schema up to the version
+// and creation time requested, zero values meaning the latest of all
+func (s *Server) Get(ctx context.Context, in *pb.Event) (*pb.Event, error) {
+	s.mu.RLock()
+	offsets := s.snaps[in.GetAggregate().GetId()]
+	s.mu.RUnlock()
+	for i := len(offsets) - 1; i >= 0; i-- {
+		snap, err := read(s.snapshots, offsets[i])
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if schema := in.GetAggregate().GetSchema(); schema != "" && snap.Aggregate.GetSchema() != schema {
+			continue
+		}
+		if v := in.GetAggregate().GetVersion(); v != 0 && snap.Aggregate.GetVersion() > v {
+			continue
+		}
+		if in.Created != nil {
+			asOf, _ := ptypes.Timestamp(in.Created)
+			if created, _ := ptypes.Timestamp(snap.Created); created.After(asOf) {
+				continue
+			}
+		}
+		return snap, nil
+	}
+	return nil, errSnapshotNotFound
+}
+
+// List streams the events matching the query params, by version when listing
+// the events of an aggregate and by sequence otherwise
+func (s *Server) List(q *pb.Query, stream pb.EventSourceProjection_ListServer) error {
+	f, err := newFilter(q.GetParams())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	sent := 0
+	for _, offset := range s.candidates(f) {
+		e, err := read(s.events, offset)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if !f.match(e) {
+			continue
+		}
+		if f.limit > 0 && sent == f.limit {
+			break
+		}
+		if err := stream.Send(e); err != nil {
+			return err
+		}
+		sent++
+	}
+	return nil
+}
+
+// Version returns the current version of the aggregate
+func (s *Server) Version(id string) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return int64(len(s.aggregates[id]))
+}
+
+// Events returns the events of the aggregate
+func (s *Server) Events(id string) ([]*pb.Event, error) {
+	s.mu.RLock()
+	offsets := s.aggregates[id]
+	s.mu.RUnlock()
+	out := make([]*pb.Event, 0, len(offsets))
+	for _, offset := range offsets {
+		e, err := read(s.events, offset)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// index adds the event at the offset to the indexes, must be called with the
+// lock held
+func (s *Server) index(offset int64, e *pb.Event) {
+	id := e.GetAggregate().GetId()
+	s.aggregates[id] = append(s.aggregates[id], offset)
+	s.sequence = append(s.sequence, offset)
+}
+
+// candidates returns the offsets of the events that may match the filter,
+// using the indexes to skip the versions and sequences out of range
+func (s *Server) candidates(f filter) []int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	offsets := s.sequence
+	lowest, highest := f.after, int64(len(offsets))
+	if f.id != "" {
+		offsets = s.aggregates[f.id]
+		lowest, highest = f.lowest-1, int64(len(offsets))
+		if f.highest != 0 && f.highest < highest {
+			highest = f.highest
+		}
+	}
+	if lowest < 0 {
+		lowest = 0
+	}
+	if lowest >= highest {
+		return nil
+	}
+	// slices are only appended to, so they can be read without the lock
+	return offsets[lowest:highest:highest]
+}
+
+func read(l Log, offset int64) (*pb.Event, error) {
+	data, err := l.ReadAt(offset)
+	if err != nil {
+		return nil, err
+	}
+	e := &pb.Event{}
+	if err := proto.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
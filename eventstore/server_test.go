@@ -0,0 +1,252 @@
+package eventstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// listStream collects the events sent by List
+type listStream struct {
+	grpc.ServerStream
+	events []*pb.Event
+}
+
+func (s *listStream) Send(e *pb.Event) error {
+	s.events = append(s.events, e)
+	return nil
+}
+
+// list returns the events listed for the params as id/version:seq
+func list(t *testing.T, s *Server, params map[string]string) (string, error) {
+	t.Helper()
+	st := &listStream{}
+	if err := s.List(&pb.Query{Params: params}, st); err != nil {
+		return "", err
+	}
+	out := make([]string, len(st.events))
+	for i, e := range st.events {
+		out[i] = fmt.Sprintf("%s/%d:%s", e.Aggregate.GetId(), e.Aggregate.GetVersion(), e.Metadata[store.SequenceMetadataKey])
+	}
+	return strings.Join(out, " "), nil
+}
+
+// created returns an event of the aggregate dispatched at the version
+func created(id string, version int64, topic, schema string, at time.Time) *pb.Event {
+	ts, _ := ptypes.TimestampProto(at)
+	return &pb.Event{Topic: topic, Created: ts, Aggregate: &pb.Aggregate{Id: id, Version: version, Schema: schema}}
+}
+
+// seed creates events of aggregates 1 and 2 interleaved, one hour apart
+func seed(t *testing.T, s *Server, start time.Time) {
+	t.Helper()
+	ctx := context.Background()
+	for i, e := range []*pb.Event{
+		created("1", 0, "order_created", "order", start),
+		created("2", 0, "order_created", "order", start.Add(1*time.Hour)),
+		created("1", 1, "order_paid", "order", start.Add(2*time.Hour)),
+		created("1", 2, "invoice_sent", "invoice", start.Add(3*time.Hour)),
+		created("2", 1, "order_paid", "order", start.Add(4*time.Hour)),
+	} {
+		if _, err := s.Create(ctx, e); err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+	}
+}
+
+func TestGetSchema(t *testing.T) {
+	s := NewMemory()
+	defer s.Close()
+	ctx := context.Background()
+	for _, a := range []*pb.Aggregate{
+		{Id: "1", Schema: "order", Version: 1},
+		{Id: "1", Schema: "invoice", Version: 2},
+		{Id: "1", Schema: "order", Version: 3},
+		{Id: "1", Schema: "invoice", Version: 4},
+	} {
+		if _, err := s.Snap(ctx, &pb.Event{Aggregate: a}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		schema  string
+		version int64
+		want    int64
+	}{
+		{"order", 0, 3},
+		{"invoice", 0, 4},
+		{"order", 2, 1},
+		{"", 0, 4},
+	} {
+		snap, err := s.Get(ctx, &pb.Event{Aggregate: &pb.Aggregate{Id: "1", Schema: tc.schema, Version: tc.version}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if snap.Aggregate.Version != tc.want {
+			t.Fatalf("expected %q snapshot at version %d got %d", tc.schema, tc.want, snap.Aggregate.Version)
+		}
+	}
+	if _, err := s.Get(ctx, &pb.Event{Aggregate: &pb.Aggregate{Id: "1", Schema: "refund"}}); err != errSnapshotNotFound {
+		t.Fatalf("expected %v got %v", errSnapshotNotFound, err)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	s := NewMemory()
+	defer s.Close()
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name string
+		e    *pb.Event
+		code codes.Code
+	}{
+		{"first", &pb.Event{Aggregate: &pb.Aggregate{Id: "1"}}, codes.OK},
+		{"next", &pb.Event{Aggregate: &pb.Aggregate{Id: "1", Version: 1}}, codes.OK},
+		{"stale version", &pb.Event{Aggregate: &pb.Aggregate{Id: "1", Version: 1}}, codes.Aborted},
+		{"version ahead", &pb.Event{Aggregate: &pb.Aggregate{Id: "1", Version: 5}}, codes.Aborted},
+		{"another aggregate", &pb.Event{Aggregate: &pb.Aggregate{Id: "2"}}, codes.OK},
+		{"no aggregate", &pb.Event{}, codes.InvalidArgument},
+		{"no aggregate id", &pb.Event{Aggregate: &pb.Aggregate{}}, codes.InvalidArgument},
+	} {
+		if _, err := s.Create(ctx, tc.e); status.Code(err) != tc.code {
+			t.Fatalf("%s: expected %v got %v", tc.name, tc.code, err)
+		}
+		if tc.e.Metadata != nil {
+			t.Fatalf("%s: expected event created not to be modified", tc.name)
+		}
+	}
+	// the version following the one dispatched and the next sequence are
+	// assigned, whatever the aggregate
+	got, err := list(t, s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1/1:1 1/2:2 2/1:3"; got != want {
+		t.Fatalf("expected %s got %s", want, got)
+	}
+	if s.Version("1") != 2 || s.Version("2") != 1 || s.Version("3") != 0 {
+		t.Fatalf("unexpected versions %d %d %d", s.Version("1"), s.Version("2"), s.Version("3"))
+	}
+}
+
+func TestList(t *testing.T) {
+	s := NewMemory()
+	defer s.Close()
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	seed(t, s, start)
+	for _, tc := range []struct {
+		name       string
+		params     map[string]string
+		want       string
+		candidates int
+	}{
+		{"all", nil, "1/1:1 2/1:2 1/2:3 1/3:4 2/2:5", 5},
+		{"aggregate", map[string]string{"AID": "1"}, "1/1:1 1/2:3 1/3:4", 3},
+		{"lowest version", map[string]string{"AID": "1", "LV": "2"}, "1/2:3 1/3:4", 2},
+		{"highest version", map[string]string{"AID": "1", "HV": "2"}, "1/1:1 1/2:3", 2},
+		{"version range", map[string]string{"AID": "1", "LV": "2", "HV": "2"}, "1/2:3", 1},
+		{"versions past the last", map[string]string{"AID": "1", "LV": "4"}, "", 0},
+		{"unknown aggregate", map[string]string{"AID": "3"}, "", 0},
+		{"after sequence", map[string]string{"SEQ": "3"}, "1/3:4 2/2:5", 2},
+		{"after last sequence", map[string]string{"SEQ": "5"}, "", 0},
+		{"aggregate after sequence", map[string]string{"AID": "1", "SEQ": "1"}, "1/2:3 1/3:4", 3},
+		{"topics", map[string]string{"TOPIC": "order_paid,invoice_sent"}, "1/2:3 1/3:4 2/2:5", 5},
+		{"schema", map[string]string{"AID": "1", "SCHEMA": "invoice"}, "1/3:4", 3},
+		{"created from", map[string]string{"CF": start.Add(3 * time.Hour).Format(time.RFC3339Nano)}, "1/3:4 2/2:5", 5},
+		{"created to", map[string]string{"CT": start.Add(1 * time.Hour).Format(time.RFC3339Nano)}, "1/1:1 2/1:2", 5},
+		{"limit", map[string]string{"LIMIT": "2"}, "1/1:1 2/1:2", 5},
+		{"limit after filter", map[string]string{"TOPIC": "order_paid", "LIMIT": "1"}, "1/2:3", 5},
+	} {
+		got, err := list(t, s, tc.params)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got != tc.want {
+			t.Fatalf("%s: expected %q got %q", tc.name, tc.want, got)
+		}
+		// the indexes skip the versions and sequences out of range
+		f, err := newFilter(tc.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(s.candidates(f)); n != tc.candidates {
+			t.Fatalf("%s: expected %d candidates got %d", tc.name, tc.candidates, n)
+		}
+	}
+	for _, params := range []map[string]string{
+		{"LV": "x"},
+		{"SEQ": "x"},
+		{"LIMIT": "x"},
+		{"CF": "yesterday"},
+	} {
+		if _, err := list(t, s, params); status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("%v: expected %v got %v", params, codes.InvalidArgument, err)
+		}
+	}
+}
+
+func TestOpenRebuildsIndexes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	seed(t, s, start)
+	ctx := context.Background()
+	if _, err := s.Snap(ctx, &pb.Event{Aggregate: &pb.Aggregate{Id: "1", Version: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := list(t, s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got, err := list(t, s, nil); err != nil || got != before {
+		t.Fatalf("expected %s got %s, %v", before, got, err)
+	}
+	if got, err := list(t, s, map[string]string{"AID": "1", "LV": "2"}); err != nil || got != "1/2:3 1/3:4" {
+		t.Fatalf("expected aggregate index rebuilt got %s, %v", got, err)
+	}
+	if s.Version("1") != 3 || s.Version("2") != 2 {
+		t.Fatalf("expected versions rebuilt got %d %d", s.Version("1"), s.Version("2"))
+	}
+	snap, err := s.Get(ctx, &pb.Event{Aggregate: &pb.Aggregate{Id: "1"}})
+	if err != nil || snap.Aggregate.Version != 2 {
+		t.Fatalf("expected snapshot index rebuilt got %v, %v", snap, err)
+	}
+	// events created after reopening continue the versions and sequence
+	if _, err := s.Create(ctx, &pb.Event{Aggregate: &pb.Aggregate{Id: "2", Version: 1}}); status.Code(err) != codes.Aborted {
+		t.Fatalf("expected %v got %v", codes.Aborted, err)
+	}
+	if _, err := s.Create(ctx, &pb.Event{Aggregate: &pb.Aggregate{Id: "2", Version: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := list(t, s, map[string]string{"SEQ": "5"}); err != nil || got != "2/3:6" {
+		t.Fatalf("expected event appended after reopening got %s, %v", got, err)
+	}
+}
@@ -0,0 +1,303 @@
+package inspect
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+)
+
+const (
+	defaultAddr = "127.0.0.1:65060"
+	usage       = `usage: es [-addr host:port] [-json] <command> [flags]
+
+commands:
+  events  list the events of an aggregate
+  state   show the state of an aggregate at a version or time
+  tail    print new events as they are appended
+
+The event store address defaults to $EVENT_SOURCE_ADDR or ` + defaultAddr + `
+`
+)
+
+// Main runs the es command line tool and exits
+func Main() {
+	if err := Run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "es: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// Run runs the es command line tool with the arguments, writing to w
+func Run(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("es", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	addr := fs.String("addr", defaultTarget(), "event store address")
+	asJSON := fs.Bool("json", false, "print one json object per line")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	ctx := pluto.New(
+		pluto.Name("es"),
+		pluto.Clients(store.NewEventSourceQueryClient(*addr)),
+	).WithContext(context.Background())
+	p := &printer{w: w, json: *asJSON}
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "events":
+		return eventsCmd(ctx, args, p)
+	case "state":
+		return stateCmd(ctx, args, p)
+	case "tail":
+		return tailCmd(ctx, args, p)
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+func defaultTarget() string {
+	if addr, ok := os.LookupEnv("EVENT_SOURCE_ADDR"); ok {
+		return addr
+	}
+	return defaultAddr
+}
+
+// eventsCmd lists the events of an aggregate
+func eventsCmd(ctx context.Context, args []string, p *printer) error {
+	fs := flag.NewFlagSet("events", flag.ContinueOnError)
+	id := fs.String("id", "", "aggregate id")
+	lowest := fs.Int64("from", 0, "lowest version listed")
+	highest := fs.Int64("to", 0, "highest version listed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *id == "" {
+		return fmt.Errorf("events: -id is required")
+	}
+	it, err := store.NewEventIterator(ctx, store.EventQuery{
+		AggregateID:    *id,
+		LowestVersion:  *lowest,
+		HighestVersion: *highest,
+		Raw:            true,
+	})
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	defer p.flush()
+	for it.Next() {
+		if err := p.event(ctx, it.Event()); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// stateCmd replays the events of an aggregate with the apply function
+// registered for its schema
+func stateCmd(ctx context.Context, args []string, p *printer) error {
+	fs := flag.NewFlagSet("state", flag.ContinueOnError)
+	id := fs.String("id", "", "aggregate id")
+	schema := fs.String("aggregate", "", "aggregate schema, e.g. *orders.Order, optional if only one is registered")
+	version := fs.Int64("version", 0, "version of the state, 0 meaning the current version")
+	at := fs.String("at", "", "time of the state in RFC3339 format")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *id == "" {
+		return fmt.Errorf("state: -id is required")
+	}
+	a, err := lookupAggregate(*schema)
+	if err != nil {
+		return err
+	}
+	// replay on a copy, the aggregator registered is shared by every run
+	s := store.NewStore(proto.Clone(a.aggregator))
+	s.HighestVersion = *version
+	if *at != "" {
+		t, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			return err
+		}
+		err = s.LoadAsOf(ctx, *id, t, a.apply)
+	} else {
+		err = s.LoadEvents(ctx, *id, a.apply)
+	}
+	if err != nil {
+		return err
+	}
+	return p.state(*id, s)
+}
+
+// tailCmd polls the event store for events appended after a sequence
+func tailCmd(ctx context.Context, args []string, p *printer) error {
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	topic := fs.String("topic", "", "topic of the events, empty meaning all topics")
+	schema := fs.String("schema", "", "schema of the events, empty meaning all schemas")
+	after := fs.Int64("after", -1, "sequence after which events are printed, -1 meaning only new events")
+	interval := fs.Duration("interval", time.Second, "polling interval")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	q := store.EventQuery{Schema: *schema, AfterSequence: *after, Raw: true}
+	if *topic != "" {
+		q.Topics = []string{*topic}
+	}
+	if q.AfterSequence < 0 {
+		// skip the events already appended
+		seq, err := lastSequence(ctx)
+		if err != nil {
+			return err
+		}
+		q.AfterSequence = seq
+	}
+	for {
+		page, err := store.ReadEvents(ctx, q)
+		if err != nil {
+			return err
+		}
+		for _, e := range page.Events {
+			if err := p.event(ctx, e); err != nil {
+				return err
+			}
+			q.AfterSequence = sequence(e)
+		}
+		p.flush()
+		if page.NextSequence != 0 {
+			q.AfterSequence = page.NextSequence
+			continue
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// lastSequence returns the sequence of the last event appended, searching for
+// it with queries of a single event rather than listing them all
+func lastSequence(ctx context.Context) (int64, error) {
+	// sequences being consecutive, an event with the sequence exists if one
+	// was appended after the previous one
+	return store.SearchLast(func(seq int64) (bool, error) {
+		return appendedAfter(ctx, seq-1)
+	})
+}
+
+// appendedAfter reports if an event was appended after the sequence
+func appendedAfter(ctx context.Context, seq int64) (bool, error) {
+	page, err := store.ReadEvents(ctx, store.EventQuery{AfterSequence: seq, Limit: 1, Raw: true})
+	if err != nil {
+		return false, err
+	}
+	return len(page.Events) > 0, nil
+}
+
+func sequence(e *pb.Event) int64 {
+	seq, _ := strconv.ParseInt(e.GetMetadata()[store.SequenceMetadataKey], 10, 64)
+	return seq
+}
+
+// -----------------------------------------------------------------------------
+
+// printer prints events and states as a table or json lines
+type printer struct {
+	w    io.Writer
+	json bool
+	tw   *tabwriter.Writer
+}
+
+type eventLine struct {
+	Sequence int64             `json:"sequence"`
+	ID       string            `json:"id"`
+	Version  int64             `json:"version"`
+	Topic    string            `json:"topic"`
+	Schema   string            `json:"schema"`
+	Created  time.Time         `json:"created"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Data     json.RawMessage   `json:"data,omitempty"`
+	// Raw and Error hold the data as stored and the error decoding it
+	Raw   []byte `json:"raw,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// event prints the event, with its data as stored if it fails to decode
+func (p *printer) event(ctx context.Context, e *pb.Event) error {
+	created, _ := ptypes.Timestamp(e.GetCreated())
+	l := eventLine{
+		Sequence: sequence(e),
+		ID:       e.GetAggregate().GetId(),
+		Version:  e.GetAggregate().GetVersion(),
+		Topic:    e.GetTopic(),
+		Schema:   e.GetAggregate().GetSchema(),
+		Created:  created,
+		Metadata: e.GetMetadata(),
+	}
+	m, err := decode(ctx, e)
+	if err == nil && m != nil {
+		l.Data, err = marshalJSON(m)
+	}
+	if err != nil {
+		l.Raw, l.Error = e.GetAggregate().GetData(), err.Error()
+	}
+	if p.json {
+		return json.NewEncoder(p.w).Encode(l)
+	}
+	data := string(l.Data)
+	if l.Error != "" {
+		data = fmt.Sprintf("raw=%s error=%q", base64.StdEncoding.EncodeToString(l.Raw), l.Error)
+	}
+	if p.tw == nil {
+		p.tw = tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(p.tw, "SEQ\tID\tVERSION\tTOPIC\tSCHEMA\tCREATED\tMETADATA\tDATA")
+	}
+	_, err = fmt.Fprintf(p.tw, "%d\t%s\t%d\t%s\t%s\t%s\t%v\t%s\n", l.Sequence, l.ID, l.Version,
+		l.Topic, l.Schema, l.Created.Format(time.RFC3339), l.Metadata, data)
+	return err
+}
+
+func (p *printer) state(id string, s *store.Store) error {
+	data, err := marshalJSON(s.State.(proto.Message))
+	if err != nil {
+		return err
+	}
+	if p.json {
+		return json.NewEncoder(p.w).Encode(struct {
+			ID      string          `json:"id"`
+			Version int64           `json:"version"`
+			State   json.RawMessage `json:"state"`
+		}{id, s.Version, data})
+	}
+	_, err = fmt.Fprintf(p.w, "id: %s\nversion: %d\nstate: %s\n", id, s.Version, data)
+	return err
+}
+
+func (p *printer) flush() {
+	if p.tw != nil {
+		p.tw.Flush()
+	}
+}
+
+func marshalJSON(m proto.Message) (json.RawMessage, error) {
+	s, err := (&jsonpb.Marshaler{OrigName: true}).MarshalToString(m)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(s), nil
+}
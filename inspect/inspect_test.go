@@ -0,0 +1,213 @@
+package inspect
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto-event-source/storetest"
+)
+
+var errStop = errors.New("stop")
+
+// lineWriter records the lines written, failing once max lines are written
+// to stop the tail command
+type lineWriter struct {
+	mu    sync.Mutex
+	max   int
+	lines []string
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lines = append(w.lines, strings.TrimSpace(string(b)))
+	if len(w.lines) == w.max {
+		return len(b), errStop
+	}
+	return len(b), nil
+}
+
+func (w *lineWriter) events(t *testing.T) []eventLine {
+	t.Helper()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	out := make([]eventLine, len(w.lines))
+	for i, l := range w.lines {
+		if err := json.Unmarshal([]byte(l), &out[i]); err != nil {
+			t.Fatalf("%v: %s", err, l)
+		}
+	}
+	return out
+}
+
+// event returns an event with the data and schema given
+func event(topic, schema string, data []byte) *pb.Event {
+	return &pb.Event{Topic: topic, Aggregate: &pb.Aggregate{Schema: schema, Data: data}}
+}
+
+func TestLastSequence(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	appended := 0
+	for _, n := range []int{0, 1, 2, 3, 5, 8, 17} {
+		for ; appended < n; appended++ {
+			h.Append("1", storetest.Event("counted", &pb.Aggregate{}))
+		}
+		seq, err := lastSequence(h.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != int64(n) {
+			t.Fatalf("expected last sequence %d got %d", n, seq)
+		}
+	}
+}
+
+func TestRunEvents(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	ack, err := json.Marshal(map[string]bool{"ok": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Append("1",
+		// decoded with the message type from the proto registry
+		storetest.Event("counted", &pb.Ack{Ok: true}),
+		// printed without data
+		event("counted", "*orders.Order", []byte("unknown")),
+		// printed as stored with the error decoding it
+		event("counted", "*es.Ack", []byte{0xff}),
+	)
+	h.Append("2", storetest.Event("counted", &pb.Ack{}))
+
+	w := &lineWriter{}
+	if err := Run([]string{"-addr", h.Target(), "-json", "events", "-id", "1", "-to", "3"}, w); err != nil {
+		t.Fatal(err)
+	}
+	lines := w.events(t)
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 events got %d", len(lines))
+	}
+	for i, l := range lines {
+		if l.ID != "1" || l.Version != int64(i+1) || l.Sequence != int64(i+1) || l.Topic != "counted" {
+			t.Fatalf("unexpected event %d %+v", i, l)
+		}
+	}
+	if string(lines[0].Data) != string(ack) || lines[0].Error != "" {
+		t.Fatalf("expected data %s got %+v", ack, lines[0])
+	}
+	if lines[1].Data != nil || lines[1].Error != "" {
+		t.Fatalf("expected unknown schema printed without data got %+v", lines[1])
+	}
+	if !bytes.Equal(lines[2].Raw, []byte{0xff}) || lines[2].Error == "" {
+		t.Fatalf("expected data as stored and error got %+v", lines[2])
+	}
+
+	// the table has a header and a row per event
+	var out bytes.Buffer
+	if err := Run([]string{"-addr", h.Target(), "events", "-id", "1", "-from", "3"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	rows := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(rows) != 2 || !strings.HasPrefix(rows[0], "SEQ") || !strings.HasPrefix(rows[1], "3 ") || !strings.Contains(rows[1], "raw=/w==") {
+		t.Fatalf("unexpected table\n%s", out.String())
+	}
+	if err := Run([]string{"-addr", h.Target(), "events"}, &out); err == nil {
+		t.Fatal("expected -id required")
+	}
+}
+
+func TestRunState(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	for i := 0; i < 3; i++ {
+		h.Append("1", storetest.Event("counted", &pb.Aggregate{}))
+	}
+	RegisterAggregate(&pb.Query{}, func(e *pb.Event, state interface{}) (interface{}, error) {
+		q := state.(*pb.Query)
+		if q.Params == nil {
+			q.Params = make(map[string]string)
+		}
+		q.Params["last"] = fmt.Sprint(e.Aggregate.GetVersion())
+		return q, nil
+	})
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-id", "1"}, `{"id":"1","version":3,"state":{"params":{"last":"3"}}}`},
+		{[]string{"-id", "1", "-version", "2"}, `{"id":"1","version":2,"state":{"params":{"last":"2"}}}`},
+		{[]string{"-id", "1", "-aggregate", "*es.Query", "-at", time.Now().Add(-time.Hour).Format(time.RFC3339)}, `{"id":"1","version":0,"state":{}}`},
+	} {
+		var out bytes.Buffer
+		args := append([]string{"-addr", h.Target(), "-json", "state"}, tc.args...)
+		if err := Run(args, &out); err != nil {
+			t.Fatalf("%v: %v", tc.args, err)
+		}
+		if got := strings.TrimSpace(out.String()); got != tc.want {
+			t.Fatalf("%v: expected %s got %s", tc.args, tc.want, got)
+		}
+	}
+	var out bytes.Buffer
+	err := Run([]string{"-addr", h.Target(), "state", "-id", "1", "-aggregate", "*orders.Order"}, &out)
+	if err == nil || !strings.Contains(err.Error(), errAggregateNotRegistered.Error()) {
+		t.Fatalf("expected %v got %v", errAggregateNotRegistered, err)
+	}
+}
+
+func TestRunTail(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	// more events than a page, of two topics
+	for i := 0; i < 150; i++ {
+		topic := "counted"
+		if i%3 == 0 {
+			topic = "skipped"
+		}
+		h.Append("1", storetest.Event(topic, &pb.Aggregate{}))
+	}
+	w := &lineWriter{max: 100}
+	err := Run([]string{"-addr", h.Target(), "-json", "tail", "-after", "0", "-topic", "counted", "-interval", "10ms"}, w)
+	if err != errStop {
+		t.Fatalf("expected %v got %v", errStop, err)
+	}
+	lines := w.events(t)
+	last := int64(0)
+	for _, l := range lines {
+		if l.Topic != "counted" || l.Sequence <= last {
+			t.Fatalf("expected counted events in order got %+v after sequence %d", l, last)
+		}
+		last = l.Sequence
+	}
+	if last != 150 {
+		t.Fatalf("expected events up to sequence 150 got %d", last)
+	}
+
+	// by default only events appended once tailing are printed
+	w = &lineWriter{max: 1}
+	done := make(chan error, 1)
+	go func() {
+		done <- Run([]string{"-addr", h.Target(), "-json", "tail", "-interval", "10ms"}, w)
+	}()
+	for {
+		select {
+		case err := <-done:
+			if err != errStop {
+				t.Fatalf("expected %v got %v", errStop, err)
+			}
+			if seq := w.events(t)[0].Sequence; seq <= 150 {
+				t.Fatalf("expected a new event got sequence %d", seq)
+			}
+			return
+		case <-time.After(20 * time.Millisecond):
+			h.Append("1", storetest.Event("counted", &pb.Aggregate{}))
+		}
+	}
+}
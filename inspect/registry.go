@@ -0,0 +1,108 @@
+// Package inspect implements the es command line tool to inspect the events of
+// an event store. Events are decoded with the message types registered, and
+// aggregate states rebuilt with the apply functions registered, so services
+// build their own tool registering their types:
+//
+//	func main() {
+//		inspect.RegisterMessages(&orders.OrderCreated{}, &orders.OrderPaid{})
+//		inspect.RegisterAggregate(&orders.Order{}, orders.Apply)
+//		inspect.Main()
+//	}
+package inspect
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+var (
+	errSchemaNotRegistered    = errors.New("schema not registered")
+	errAggregateNotRegistered = errors.New("aggregate not registered")
+)
+
+type aggregate struct {
+	aggregator proto.Message
+	apply      store.ApplyFn
+}
+
+var registry = struct {
+	sync.RWMutex
+	messages   map[string]reflect.Type
+	aggregates map[string]aggregate
+}{
+	messages:   make(map[string]reflect.Type),
+	aggregates: make(map[string]aggregate),
+}
+
+// RegisterMessages registers the messages used as event data, by schema
+func RegisterMessages(msgs ...proto.Message) {
+	registry.Lock()
+	defer registry.Unlock()
+	for _, m := range msgs {
+		registry.messages[fmt.Sprintf("%T", m)] = reflect.TypeOf(m)
+	}
+}
+
+// RegisterAggregate registers the aggregator and its apply function, used to
+// rebuild the state of aggregates of its schema
+func RegisterAggregate(aggregator proto.Message, apply store.ApplyFn) {
+	registry.Lock()
+	defer registry.Unlock()
+	schema := fmt.Sprintf("%T", aggregator)
+	registry.aggregates[schema] = aggregate{aggregator: aggregator, apply: apply}
+	registry.messages[schema] = reflect.TypeOf(aggregator)
+}
+
+// newMessage returns an empty message of the schema, from the messages
+// registered or else from the proto registry, assuming the go package name
+// matches the proto package name
+func newMessage(schema string) (proto.Message, error) {
+	registry.RLock()
+	t, ok := registry.messages[schema]
+	registry.RUnlock()
+	if !ok {
+		t = proto.MessageType(strings.TrimPrefix(schema, "*"))
+	}
+	if t == nil {
+		return nil, errors.Wrap(errSchemaNotRegistered, schema)
+	}
+	return reflect.New(t.Elem()).Interface().(proto.Message), nil
+}
+
+// lookupAggregate returns the aggregate registered by schema, or the only one
+// registered if schema is empty
+func lookupAggregate(schema string) (aggregate, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+	if schema == "" && len(registry.aggregates) == 1 {
+		for _, a := range registry.aggregates {
+			return a, nil
+		}
+	}
+	a, ok := registry.aggregates[schema]
+	if !ok {
+		return aggregate{}, errors.Wrap(errAggregateNotRegistered, schema)
+	}
+	return a, nil
+}
+
+// decode returns the event data decoded, or nil if its schema is unknown
+func decode(ctx context.Context, e *pb.Event) (proto.Message, error) {
+	m, err := newMessage(e.GetAggregate().GetSchema())
+	if err != nil {
+		return nil, nil
+	}
+	if err := store.UnmarshalEventDataContext(ctx, e, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,537 @@
+package pubsubtest
+
+import (
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/empty"
+	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+)
+
+const (
+	deletedTopic = "_deleted-topic_"
+
+	defaultAckDeadlineSeconds = 10
+	// pollInterval interval at which streaming pulls deliver new messages and
+	// messages whose ack deadline expired
+	pollInterval = 10 * time.Millisecond
+)
+
+var (
+	errTopicNotFound        = status.Error(codes.NotFound, "topic not found")
+	errTopicExists          = status.Error(codes.AlreadyExists, "topic already exists")
+	errSubscriptionNotFound = status.Error(codes.NotFound, "subscription not found")
+	errSubscriptionExists   = status.Error(codes.AlreadyExists, "subscription already exists")
+)
+
+// Server is an in-process fake of the Cloud PubSub publisher and subscriber
+// services. Messages are kept in memory and delivered at least once to every
+// subscription of their topic, nacked messages and messages not acked within
+// the ack deadline being redelivered. Snapshots, seek and push subscriptions
+// are not supported
+type Server struct {
+	mu     sync.Mutex
+	topics map[string]*pb.Topic
+	subs   map[string]*subscription
+	// ids holds the last message id and ack id assigned
+	ids int64
+	srv *grpc.Server
+	lis net.Listener
+}
+
+type subscription struct {
+	proto       *pb.Subscription
+	pending     []*pb.PubsubMessage
+	outstanding map[string]*delivery
+}
+
+type delivery struct {
+	msg      *pb.PubsubMessage
+	deadline time.Time
+}
+
+// NewServer starts a fake server listening on a local port
+func NewServer() (*Server, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		topics: make(map[string]*pb.Topic),
+		subs:   make(map[string]*subscription),
+		srv:    grpc.NewServer(),
+		lis:    lis,
+	}
+	pb.RegisterPublisherServer(s.srv, s)
+	pb.RegisterSubscriberServer(s.srv, s)
+	go s.srv.Serve(lis)
+	return s, nil
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() string {
+	return s.lis.Addr().String()
+}
+
+// Close stops the server
+func (s *Server) Close() {
+	s.srv.Stop()
+}
+
+// Outstanding returns the number of messages of the subscription not acked
+// yet, either waiting for delivery or delivered
+func (s *Server) Outstanding(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for n, sub := range s.subs {
+		if n == name || strings.HasSuffix(n, "/subscriptions/"+name) {
+			return len(sub.pending) + len(sub.outstanding)
+		}
+	}
+	return 0
+}
+
+// -----------------------------------------------------------------------------
+// Publisher
+
+// CreateTopic creates the topic
+func (s *Server) CreateTopic(ctx context.Context, in *pb.Topic) (*pb.Topic, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.topics[in.GetName()]; ok {
+		return nil, errTopicExists
+	}
+	s.topics[in.Name] = proto.Clone(in).(*pb.Topic)
+	return in, nil
+}
+
+// UpdateTopic updates the labels of the topic
+func (s *Server) UpdateTopic(ctx context.Context, in *pb.UpdateTopicRequest) (*pb.Topic, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.topics[in.GetTopic().GetName()]
+	if !ok {
+		return nil, errTopicNotFound
+	}
+	for _, path := range in.GetUpdateMask().GetPaths() {
+		switch path {
+		case "labels":
+			t.Labels = in.Topic.Labels
+		case "message_storage_policy":
+			t.MessageStoragePolicy = in.Topic.MessageStoragePolicy
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "unknown field %s", path)
+		}
+	}
+	return proto.Clone(t).(*pb.Topic), nil
+}
+
+// Publish adds the messages to every subscription of the topic
+func (s *Server) Publish(ctx context.Context, in *pb.PublishRequest) (*pb.PublishResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.topics[in.GetTopic()]; !ok {
+		return nil, errTopicNotFound
+	}
+	res := &pb.PublishResponse{}
+	for _, m := range in.GetMessages() {
+		m = proto.Clone(m).(*pb.PubsubMessage)
+		m.MessageId = s.nextID()
+		m.PublishTime = ptypes.TimestampNow()
+		for _, sub := range s.subs {
+			if sub.proto.Topic == in.Topic {
+				sub.pending = append(sub.pending, m)
+			}
+		}
+		res.MessageIds = append(res.MessageIds, m.MessageId)
+	}
+	return res, nil
+}
+
+// GetTopic returns the topic
+func (s *Server) GetTopic(ctx context.Context, in *pb.GetTopicRequest) (*pb.Topic, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.topics[in.GetTopic()]
+	if !ok {
+		return nil, errTopicNotFound
+	}
+	return proto.Clone(t).(*pb.Topic), nil
+}
+
+// ListTopics returns all topics of the project
+func (s *Server) ListTopics(ctx context.Context, in *pb.ListTopicsRequest) (*pb.ListTopicsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := &pb.ListTopicsResponse{}
+	for _, name := range sortedNames(s.topics) {
+		if strings.HasPrefix(name, in.GetProject()+"/topics/") {
+			res.Topics = append(res.Topics, proto.Clone(s.topics[name]).(*pb.Topic))
+		}
+	}
+	return res, nil
+}
+
+// ListTopicSubscriptions returns the names of all subscriptions of the topic
+func (s *Server) ListTopicSubscriptions(ctx context.Context, in *pb.ListTopicSubscriptionsRequest) (*pb.ListTopicSubscriptionsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.topics[in.GetTopic()]; !ok {
+		return nil, errTopicNotFound
+	}
+	res := &pb.ListTopicSubscriptionsResponse{}
+	for _, name := range sortedNames(s.subs) {
+		if s.subs[name].proto.Topic == in.Topic {
+			res.Subscriptions = append(res.Subscriptions, name)
+		}
+	}
+	return res, nil
+}
+
+// ListTopicSnapshots is not supported
+func (s *Server) ListTopicSnapshots(ctx context.Context, in *pb.ListTopicSnapshotsRequest) (*pb.ListTopicSnapshotsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "snapshots not supported")
+}
+
+// DeleteTopic deletes the topic, its subscriptions are kept detached from it
+func (s *Server) DeleteTopic(ctx context.Context, in *pb.DeleteTopicRequest) (*empty.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.topics[in.GetTopic()]; !ok {
+		return nil, errTopicNotFound
+	}
+	delete(s.topics, in.Topic)
+	for _, sub := range s.subs {
+		if sub.proto.Topic == in.Topic {
+			sub.proto.Topic = deletedTopic
+		}
+	}
+	return &empty.Empty{}, nil
+}
+
+// -----------------------------------------------------------------------------
+// Subscriber
+
+// CreateSubscription creates a pull subscription to the topic, receiving the
+// messages published from now on
+func (s *Server) CreateSubscription(ctx context.Context, in *pb.Subscription) (*pb.Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subs[in.GetName()]; ok {
+		return nil, errSubscriptionExists
+	}
+	if _, ok := s.topics[in.GetTopic()]; !ok {
+		return nil, errTopicNotFound
+	}
+	if in.GetPushConfig().GetPushEndpoint() != "" {
+		return nil, status.Error(codes.Unimplemented, "push subscriptions not supported")
+	}
+	p := proto.Clone(in).(*pb.Subscription)
+	if p.AckDeadlineSeconds == 0 {
+		p.AckDeadlineSeconds = defaultAckDeadlineSeconds
+	}
+	if p.PushConfig == nil {
+		p.PushConfig = &pb.PushConfig{}
+	}
+	s.subs[p.Name] = &subscription{proto: p, outstanding: make(map[string]*delivery)}
+	return proto.Clone(p).(*pb.Subscription), nil
+}
+
+// GetSubscription returns the subscription
+func (s *Server) GetSubscription(ctx context.Context, in *pb.GetSubscriptionRequest) (*pb.Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subs[in.GetSubscription()]
+	if !ok {
+		return nil, errSubscriptionNotFound
+	}
+	return proto.Clone(sub.proto).(*pb.Subscription), nil
+}
+
+// UpdateSubscription updates the ack deadline, labels and retention of the
+// subscription
+func (s *Server) UpdateSubscription(ctx context.Context, in *pb.UpdateSubscriptionRequest) (*pb.Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subs[in.GetSubscription().GetName()]
+	if !ok {
+		return nil, errSubscriptionNotFound
+	}
+	for _, path := range in.GetUpdateMask().GetPaths() {
+		switch path {
+		case "ack_deadline_seconds":
+			sub.proto.AckDeadlineSeconds = in.Subscription.AckDeadlineSeconds
+		case "labels":
+			sub.proto.Labels = in.Subscription.Labels
+		case "retain_acked_messages":
+			sub.proto.RetainAckedMessages = in.Subscription.RetainAckedMessages
+		case "message_retention_duration":
+			sub.proto.MessageRetentionDuration = in.Subscription.MessageRetentionDuration
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "unknown field %s", path)
+		}
+	}
+	return proto.Clone(sub.proto).(*pb.Subscription), nil
+}
+
+// ListSubscriptions returns all subscriptions of the project
+func (s *Server) ListSubscriptions(ctx context.Context, in *pb.ListSubscriptionsRequest) (*pb.ListSubscriptionsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := &pb.ListSubscriptionsResponse{}
+	for _, name := range sortedNames(s.subs) {
+		if strings.HasPrefix(name, in.GetProject()+"/subscriptions/") {
+			res.Subscriptions = append(res.Subscriptions, proto.Clone(s.subs[name].proto).(*pb.Subscription))
+		}
+	}
+	return res, nil
+}
+
+// DeleteSubscription deletes the subscription and its messages
+func (s *Server) DeleteSubscription(ctx context.Context, in *pb.DeleteSubscriptionRequest) (*empty.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subs[in.GetSubscription()]; !ok {
+		return nil, errSubscriptionNotFound
+	}
+	delete(s.subs, in.Subscription)
+	return &empty.Empty{}, nil
+}
+
+// ModifyAckDeadline extends the ack deadline of the messages, a zero deadline
+// making them available for redelivery
+func (s *Server) ModifyAckDeadline(ctx context.Context, in *pb.ModifyAckDeadlineRequest) (*empty.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subs[in.GetSubscription()]
+	if !ok {
+		return nil, errSubscriptionNotFound
+	}
+	for _, id := range in.GetAckIds() {
+		sub.modifyAckDeadline(id, in.AckDeadlineSeconds)
+	}
+	return &empty.Empty{}, nil
+}
+
+// Acknowledge removes the messages from the subscription
+func (s *Server) Acknowledge(ctx context.Context, in *pb.AcknowledgeRequest) (*empty.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subs[in.GetSubscription()]
+	if !ok {
+		return nil, errSubscriptionNotFound
+	}
+	for _, id := range in.GetAckIds() {
+		delete(sub.outstanding, id)
+	}
+	return &empty.Empty{}, nil
+}
+
+// Pull returns the messages available, without waiting for new ones
+func (s *Server) Pull(ctx context.Context, in *pb.PullRequest) (*pb.PullResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subs[in.GetSubscription()]
+	if !ok {
+		return nil, errSubscriptionNotFound
+	}
+	return &pb.PullResponse{ReceivedMessages: s.deliver(sub, int(in.MaxMessages), sub.proto.AckDeadlineSeconds)}, nil
+}
+
+// StreamingPull streams the messages available until the client closes the
+// stream or the subscription is deleted, applying the acks and ack deadline
+// modifications received
+func (s *Server) StreamingPull(stream pb.Subscriber_StreamingPullServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	name := req.GetSubscription()
+	s.mu.Lock()
+	_, ok := s.subs[name]
+	s.mu.Unlock()
+	if !ok {
+		return errSubscriptionNotFound
+	}
+	deadline := req.StreamAckDeadlineSeconds
+	done := make(chan error, 1)
+	go func() {
+		for {
+			if err := s.streamingRequest(name, req); err != nil {
+				done <- err
+				return
+			}
+			if req, err = stream.Recv(); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				done <- err
+				return
+			}
+		}
+	}()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		sub, ok := s.subs[name]
+		var msgs []*pb.ReceivedMessage
+		if ok {
+			msgs = s.deliver(sub, 0, deadline)
+		}
+		s.mu.Unlock()
+		if !ok {
+			return errSubscriptionNotFound
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+		if err := stream.Send(&pb.StreamingPullResponse{ReceivedMessages: msgs}); err != nil {
+			return err
+		}
+	}
+}
+
+// streamingRequest applies the acks and ack deadline modifications of a
+// streaming pull request
+func (s *Server) streamingRequest(name string, req *pb.StreamingPullRequest) error {
+	if len(req.ModifyDeadlineAckIds) != len(req.ModifyDeadlineSeconds) {
+		return status.Error(codes.InvalidArgument, "modify_deadline_ack_ids and modify_deadline_seconds lengths differ")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subs[name]
+	if !ok {
+		return errSubscriptionNotFound
+	}
+	for _, id := range req.AckIds {
+		delete(sub.outstanding, id)
+	}
+	for i, id := range req.ModifyDeadlineAckIds {
+		sub.modifyAckDeadline(id, req.ModifyDeadlineSeconds[i])
+	}
+	return nil
+}
+
+// ModifyPushConfig is not supported
+func (s *Server) ModifyPushConfig(ctx context.Context, in *pb.ModifyPushConfigRequest) (*empty.Empty, error) {
+	return nil, status.Error(codes.Unimplemented, "push subscriptions not supported")
+}
+
+// GetSnapshot is not supported
+func (s *Server) GetSnapshot(ctx context.Context, in *pb.GetSnapshotRequest) (*pb.Snapshot, error) {
+	return nil, status.Error(codes.Unimplemented, "snapshots not supported")
+}
+
+// ListSnapshots is not supported
+func (s *Server) ListSnapshots(ctx context.Context, in *pb.ListSnapshotsRequest) (*pb.ListSnapshotsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "snapshots not supported")
+}
+
+// CreateSnapshot is not supported
+func (s *Server) CreateSnapshot(ctx context.Context, in *pb.CreateSnapshotRequest) (*pb.Snapshot, error) {
+	return nil, status.Error(codes.Unimplemented, "snapshots not supported")
+}
+
+// UpdateSnapshot is not supported
+func (s *Server) UpdateSnapshot(ctx context.Context, in *pb.UpdateSnapshotRequest) (*pb.Snapshot, error) {
+	return nil, status.Error(codes.Unimplemented, "snapshots not supported")
+}
+
+// DeleteSnapshot is not supported
+func (s *Server) DeleteSnapshot(ctx context.Context, in *pb.DeleteSnapshotRequest) (*empty.Empty, error) {
+	return nil, status.Error(codes.Unimplemented, "snapshots not supported")
+}
+
+// Seek is not supported
+func (s *Server) Seek(ctx context.Context, in *pb.SeekRequest) (*pb.SeekResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "seek not supported")
+}
+
+// -----------------------------------------------------------------------------
+
+// deliver returns up to max messages of the subscription, 0 meaning all, after
+// making those whose ack deadline expired available again. Must be called with
+// the lock held
+func (s *Server) deliver(sub *subscription, max int, deadlineSeconds int32) []*pb.ReceivedMessage {
+	now := time.Now()
+	for id, d := range sub.outstanding {
+		if now.After(d.deadline) {
+			delete(sub.outstanding, id)
+			sub.pending = append(sub.pending, d.msg)
+		}
+	}
+	if deadlineSeconds <= 0 {
+		deadlineSeconds = sub.proto.AckDeadlineSeconds
+	}
+	n := len(sub.pending)
+	if max > 0 && max < n {
+		n = max
+	}
+	msgs := make([]*pb.ReceivedMessage, 0, n)
+	for _, m := range sub.pending[:n] {
+		// every delivery has its own ack id so acks of a previous delivery of
+		// a message are ignored
+		id := m.MessageId + "-" + s.nextID()
+		sub.outstanding[id] = &delivery{msg: m, deadline: now.Add(time.Duration(deadlineSeconds) * time.Second)}
+		msgs = append(msgs, &pb.ReceivedMessage{AckId: id, Message: m})
+	}
+	sub.pending = sub.pending[n:]
+	return msgs
+}
+
+// nextID returns a new id, must be called with the lock held
+func (s *Server) nextID() string {
+	s.ids++
+	return strconv.FormatInt(s.ids, 10)
+}
+
+// modifyAckDeadline extends the ack deadline of the message or makes it
+// available again if seconds is zero, must be called with the lock held
+func (sub *subscription) modifyAckDeadline(id string, seconds int32) {
+	d, ok := sub.outstanding[id]
+	if !ok {
+		return
+	}
+	if seconds <= 0 {
+		delete(sub.outstanding, id)
+		sub.pending = append(sub.pending, d.msg)
+		return
+	}
+	d.deadline = time.Now().Add(time.Duration(seconds) * time.Second)
+}
+
+func sortedNames(m interface{}) []string {
+	var names []string
+	switch m := m.(type) {
+	case map[string]*pb.Topic:
+		for n := range m {
+			names = append(names, n)
+		}
+	case map[string]*subscription:
+		for n := range m {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
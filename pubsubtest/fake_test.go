@@ -0,0 +1,109 @@
+package pubsubtest
+
+import (
+	"testing"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+)
+
+const (
+	testTopic = "projects/p/topics/t"
+	testSub   = "projects/p/subscriptions/s"
+)
+
+// fakeClients returns clients of a fake server with a topic and subscription
+func fakeClients(t *testing.T) (pb.PublisherClient, pb.SubscriberClient, func()) {
+	t.Helper()
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := grpc.Dial(s.Addr(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, sub := pb.NewPublisherClient(conn), pb.NewSubscriberClient(conn)
+	ctx := context.Background()
+	if _, err := pub.CreateTopic(ctx, &pb.Topic{Name: testTopic}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sub.CreateSubscription(ctx, &pb.Subscription{Name: testSub, Topic: testTopic}); err != nil {
+		t.Fatal(err)
+	}
+	return pub, sub, func() {
+		conn.Close()
+		s.Close()
+	}
+}
+
+func publish(t *testing.T, pub pb.PublisherClient, data ...string) {
+	t.Helper()
+	req := &pb.PublishRequest{Topic: testTopic}
+	for _, d := range data {
+		req.Messages = append(req.Messages, &pb.PubsubMessage{Data: []byte(d)})
+	}
+	if _, err := pub.Publish(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pull(t *testing.T, sub pb.SubscriberClient) []*pb.ReceivedMessage {
+	t.Helper()
+	res, err := sub.Pull(context.Background(), &pb.PullRequest{Subscription: testSub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.ReceivedMessages
+}
+
+func TestServerPullAck(t *testing.T) {
+	pub, sub, stop := fakeClients(t)
+	defer stop()
+	ctx := context.Background()
+	publish(t, pub, "a", "b")
+	msgs := pull(t, sub)
+	if len(msgs) != 2 || string(msgs[0].Message.Data) != "a" {
+		t.Fatalf("expected messages in publish order got %v", msgs)
+	}
+	if again := pull(t, sub); len(again) != 0 {
+		t.Fatalf("expected messages delivered once within the ack deadline got %v", again)
+	}
+	// a is acked, b made available again
+	if _, err := sub.Acknowledge(ctx, &pb.AcknowledgeRequest{Subscription: testSub, AckIds: []string{msgs[0].AckId}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sub.ModifyAckDeadline(ctx, &pb.ModifyAckDeadlineRequest{Subscription: testSub, AckIds: []string{msgs[1].AckId}}); err != nil {
+		t.Fatal(err)
+	}
+	redelivered := pull(t, sub)
+	if len(redelivered) != 1 || string(redelivered[0].Message.Data) != "b" || redelivered[0].AckId == msgs[1].AckId {
+		t.Fatalf("expected b redelivered with a new ack id got %v", redelivered)
+	}
+}
+
+func TestServerDeleteTopic(t *testing.T) {
+	pub, sub, stop := fakeClients(t)
+	defer stop()
+	ctx := context.Background()
+	if _, err := pub.CreateTopic(ctx, &pb.Topic{Name: testTopic}); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected %v got %v", codes.AlreadyExists, err)
+	}
+	if _, err := pub.DeleteTopic(ctx, &pb.DeleteTopicRequest{Topic: testTopic}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := sub.GetSubscription(ctx, &pb.GetSubscriptionRequest{Subscription: testSub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Topic != deletedTopic {
+		t.Fatalf("expected subscription detached from the topic deleted got %q", s.Topic)
+	}
+	if _, err := pub.Publish(ctx, &pb.PublishRequest{Topic: testTopic}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected %v got %v", codes.NotFound, err)
+	}
+}
@@ -0,0 +1,262 @@
+// Package pubsubtest runs the subscribers of a service against an in-process
+// fake Cloud PubSub server, or the PubSub emulator when PUBSUB_EMULATOR_HOST
+// is set, to cover the wiring of Subscribe and its actions.
+//
+//	h := pubsubtest.New(t)
+//	defer h.Close()
+//	r := pubsubtest.Record(billing.OnOrderCreated)
+//	h.Subscribe("billing", store.Topics{"order_created": {r.Action}})
+//	e := storetest.Event("order_created", created)
+//	h.Publish(e)
+//	h.WaitAcked(r, e)
+package pubsubtest
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+
+	"cloud.google.com/go/pubsub"
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	defaultProject = "test"
+	defaultEnv     = "test"
+)
+
+// DefaultWaitTimeout time WaitAcked waits for the events to be acked
+var DefaultWaitTimeout = 10 * time.Second
+
+var (
+	// envMu guards the number of harnesses open and the GCP_PROJECT_ENV
+	// value before the first of them was opened
+	envMu       sync.Mutex
+	envHarness  int
+	envPrevious string
+	envWasSet   bool
+)
+
+// Harness holds a Cloud PubSub client connected to a fake server or to the
+// PubSub emulator
+type Harness struct {
+	t         testing.TB
+	fake      *Server
+	client    *pubsub.Client
+	publisher *store.PubsubPublisher
+	ctx       context.Context
+	cancel    context.CancelFunc
+	// env is true until the harness releases GCP_PROJECT_ENV
+	env bool
+}
+
+// New starts a new harness, it must be closed at the end of the test. The
+// project is read from GCP_PROJECT and the topics prefix from GCP_PROJECT_ENV,
+// both defaulting to test. As the store reads GCP_PROJECT_ENV from the process
+// environment, it is set while any harness is open and restored once the last
+// one is closed, so harnesses of parallel tests share the same prefix
+func New(t testing.TB) *Harness {
+	t.Helper()
+	h := &Harness{t: t, env: true}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	project, ok := os.LookupEnv("GCP_PROJECT")
+	if !ok {
+		project = defaultProject
+	}
+	acquireEnv()
+	var opts []option.ClientOption
+	if _, ok := os.LookupEnv("PUBSUB_EMULATOR_HOST"); !ok {
+		fake, err := NewServer()
+		if err != nil {
+			h.Close()
+			t.Fatalf("pubsubtest: %v", err)
+		}
+		h.fake = fake
+		conn, err := grpc.Dial(fake.Addr(), grpc.WithInsecure())
+		if err != nil {
+			h.Close()
+			t.Fatalf("pubsubtest: %v", err)
+		}
+		opts = append(opts, option.WithGRPCConn(conn))
+	}
+	client, err := pubsub.NewClient(h.ctx, project, opts...)
+	if err != nil {
+		h.Close()
+		t.Fatalf("pubsubtest: %v", err)
+	}
+	h.client = client
+	h.publisher = store.NewPubsubPublisher(client)
+	return h
+}
+
+// Client returns the Cloud PubSub client, to be passed to Subscribe
+func (h *Harness) Client() *pubsub.Client {
+	return h.client
+}
+
+// Context returns the context subscriptions run with, cancelled on Close
+func (h *Harness) Context() context.Context {
+	return h.ctx
+}
+
+// Server returns the fake server, nil if running against the emulator
+func (h *Harness) Server() *Server {
+	return h.fake
+}
+
+// Close stops the subscriptions, the client and the fake server
+func (h *Harness) Close() {
+	h.cancel()
+	if h.publisher != nil {
+		h.publisher.Stop()
+	}
+	if h.client != nil {
+		h.client.Close()
+	}
+	if h.fake != nil {
+		h.fake.Close()
+	}
+	if h.env {
+		h.env = false
+		releaseEnv()
+	}
+}
+
+// acquireEnv sets GCP_PROJECT_ENV to the default if the first harness opened
+// finds it unset
+func acquireEnv() {
+	envMu.Lock()
+	defer envMu.Unlock()
+	if envHarness == 0 {
+		envPrevious, envWasSet = os.LookupEnv("GCP_PROJECT_ENV")
+		if !envWasSet {
+			os.Setenv("GCP_PROJECT_ENV", defaultEnv)
+		}
+	}
+	envHarness++
+}
+
+// releaseEnv restores GCP_PROJECT_ENV once the last harness open is closed
+func releaseEnv() {
+	envMu.Lock()
+	defer envMu.Unlock()
+	envHarness--
+	if envHarness > 0 {
+		return
+	}
+	if envWasSet {
+		os.Setenv("GCP_PROJECT_ENV", envPrevious)
+	} else {
+		os.Unsetenv("GCP_PROJECT_ENV")
+	}
+}
+
+// Subscribe runs Subscribe for the service, creating its topics and
+// subscriptions. Only events published after it are received
+func (h *Harness) Subscribe(name string, topics store.Topics, opts ...store.SubscribeOption) {
+	h.t.Helper()
+	if err := store.Subscribe(h.client, name, topics, opts...)(h.ctx); err != nil {
+		h.t.Fatalf("pubsubtest: subscribe %s: %v", name, err)
+	}
+}
+
+// Publish publishes the events to the topics named after their topic
+func (h *Harness) Publish(events ...*pb.Event) {
+	h.t.Helper()
+	for _, e := range events {
+		if err := h.publisher.Publish(h.ctx, e); err != nil {
+			h.t.Fatalf("pubsubtest: publish %s: %v", e.GetTopic(), err)
+		}
+	}
+}
+
+// WaitAcked waits until the recorded action acked every event, failing the
+// test after DefaultWaitTimeout
+func (h *Harness) WaitAcked(r *ActionRecorder, events ...*pb.Event) {
+	h.t.Helper()
+	deadline := time.Now().Add(DefaultWaitTimeout)
+	for {
+		missing := unmatched(r.Acked(), events)
+		if len(missing) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatalf("pubsubtest: %d of %d events not acked after %v, first missing %s on %s",
+				len(missing), len(events), DefaultWaitTimeout, missing[0].GetAggregate().GetId(), missing[0].GetTopic())
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// ActionRecorder records the events handled by an action. An event is acked
+// by the action when it returns nil and nacked otherwise
+type ActionRecorder struct {
+	action store.Action
+	mu     sync.Mutex
+	acked  []*pb.Event
+	nacked []*pb.Event
+}
+
+// Record returns a recorder of the action, nil meaning an action returning nil
+func Record(action store.Action) *ActionRecorder {
+	return &ActionRecorder{action: action}
+}
+
+// Action runs the action recorded, to be passed to Subscribe
+func (r *ActionRecorder) Action(ctx context.Context, e *pb.Event) error {
+	var err error
+	if r.action != nil {
+		err = r.action(ctx, e)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.nacked = append(r.nacked, e)
+		return err
+	}
+	r.acked = append(r.acked, e)
+	return nil
+}
+
+// Acked returns the events acked, redelivered events being recorded again
+func (r *ActionRecorder) Acked() []*pb.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*pb.Event(nil), r.acked...)
+}
+
+// Nacked returns the events nacked
+func (r *ActionRecorder) Nacked() []*pb.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*pb.Event(nil), r.nacked...)
+}
+
+// unmatched returns the events wanted not found in got, each event got
+// matching at most one event wanted
+func unmatched(got, want []*pb.Event) []*pb.Event {
+	used := make([]bool, len(got))
+	var out []*pb.Event
+	for _, w := range want {
+		found := false
+		for i, g := range got {
+			if !used[i] && proto.Equal(g, w) {
+				used[i], found = true, true
+				break
+			}
+		}
+		if !found {
+			out = append(out, w)
+		}
+	}
+	return out
+}
@@ -0,0 +1,104 @@
+package pubsubtest
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto-event-source/store"
+)
+
+func event(topic, id string) *pb.Event {
+	e, err := store.NewEvent(topic, &pb.Aggregate{Id: id})
+	if err != nil {
+		panic(err)
+	}
+	e.Aggregate.Id = id
+	return e
+}
+
+// waitOutstanding waits until the subscription has no message left to ack
+func waitOutstanding(t *testing.T, h *Harness, name string) {
+	t.Helper()
+	deadline := time.Now().Add(DefaultWaitTimeout)
+	for h.Server().Outstanding(name) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s messages acked got %d outstanding", name, h.Server().Outstanding(name))
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func TestHarnessPublishAcked(t *testing.T) {
+	h := New(t)
+	defer h.Close()
+	if h.Server() == nil {
+		t.Skip("running against the PubSub emulator")
+	}
+	r := Record(nil)
+	h.Subscribe("billing", store.Topics{"order_created": {r.Action}})
+	events := []*pb.Event{event("order_created", "1"), event("order_created", "2")}
+	h.Publish(events...)
+	h.WaitAcked(r, events...)
+	if n := len(r.Nacked()); n != 0 {
+		t.Fatalf("expected no event nacked got %d", n)
+	}
+	waitOutstanding(t, h, store.SubscriptionName(os.Getenv("GCP_PROJECT_ENV"), "billing", "order_created"))
+}
+
+func TestHarnessRedelivered(t *testing.T) {
+	h := New(t)
+	defer h.Close()
+	var mu sync.Mutex
+	failed := false
+	r := Record(func(ctx context.Context, e *pb.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !failed {
+			failed = true
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	h.Subscribe("billing", store.Topics{"order_paid": {r.Action}})
+	e := event("order_paid", "1")
+	h.Publish(e)
+	h.WaitAcked(r, e)
+	if nacked := r.Nacked(); len(nacked) != 1 || unmatched(nacked, []*pb.Event{e}) != nil {
+		t.Fatalf("expected event nacked once got %v", nacked)
+	}
+}
+
+func TestHarnessEnv(t *testing.T) {
+	prev, set := os.LookupEnv("GCP_PROJECT_ENV")
+	first := New(t)
+	second := New(t)
+	env := os.Getenv("GCP_PROJECT_ENV")
+	if set && env != prev || !set && env != defaultEnv {
+		t.Fatalf("expected GCP_PROJECT_ENV %q got %q", prev, env)
+	}
+	first.Close()
+	if got := os.Getenv("GCP_PROJECT_ENV"); got != env {
+		t.Fatalf("expected GCP_PROJECT_ENV kept while a harness is open got %q", got)
+	}
+	second.Close()
+	second.Close()
+	if got, ok := os.LookupEnv("GCP_PROJECT_ENV"); got != prev || ok != set {
+		t.Fatalf("expected GCP_PROJECT_ENV restored to %q got %q", prev, got)
+	}
+}
+
+func TestUnmatched(t *testing.T) {
+	a, b := event("t", "a"), event("t", "b")
+	if got := unmatched([]*pb.Event{a, b}, []*pb.Event{b, a}); got != nil {
+		t.Fatalf("expected events matched in any order got %v", got)
+	}
+	if got := unmatched([]*pb.Event{a}, []*pb.Event{a, a}); len(got) != 1 {
+		t.Fatalf("expected event got once to match once got %v", got)
+	}
+}
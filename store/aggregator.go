@@ -9,6 +9,8 @@ import (
 	"github.com/aukbit/pluto"
 	"github.com/golang/protobuf/proto"
 	"github.com/rs/zerolog"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -19,23 +21,81 @@ var ErrConcurrencyException = status.Error(codes.Aborted, "concurrency exception
 // Validate helper functions to validate the aggregate
 type Validate func(*Store) error
 
-// Aggregate proceess all aggregate steps
+// Aggregate proceess all aggregate steps. Every validation is run and their
+// violations are returned together as a *ValidationError.
+// If the command carries an idempotency key, see WithIdempotencyKey, already
+// used by a recent event of the aggregate the current state is returned
+// without dispatching a new event
 func Aggregate(ctx context.Context, aggregator interface{}, id string, in proto.Message, topic string, metadata map[string]string, apply ApplyFn, validations ...Validate) (*Store, error) {
+	vs := make([]Validator, len(validations))
+	for i, v := range validations {
+		vs[i] = v
+	}
+	return aggregate(ctx, aggregator, id, in, topic, metadata, apply, vs)
+}
+
+// AggregateCommand is Aggregate with validations given the context and the
+// command, e.g. to check the caller or the time the command is run at
+func AggregateCommand(ctx context.Context, aggregator interface{}, id string, in proto.Message, topic string, metadata map[string]string, apply ApplyFn, validations ...CommandValidate) (*Store, error) {
+	vs := make([]Validator, len(validations))
+	for i, v := range validations {
+		vs[i] = v
+	}
+	return aggregate(ctx, aggregator, id, in, topic, metadata, apply, vs)
+}
+
+func aggregate(ctx context.Context, aggregator interface{}, id string, in proto.Message, topic string, metadata map[string]string, apply ApplyFn, validations []Validator) (_ *Store, err error) {
+	ctx, span := trace.StartSpan(ctx, "store.Aggregate")
+	span.AddAttributes(trace.StringAttribute("aggregate_id", id), trace.StringAttribute("topic", topic))
+	defer func() { endSpan(span, err) }()
 	l := zerolog.Ctx(ctx)
 
 	// Initialize aggregator store
 	s := NewStore(aggregator)
 
-	// Load events into store
-	if err := s.LoadEvents(ctx, id, apply); err != nil {
+	// Start from the cached state, if available, to only load newer events
+	cache, cached := StateCacheFromContext(ctx)
+	hit := false
+	if cached {
+		if state, version, ok := cache.Get(aggregator, id); ok {
+			s.State = state
+			s.Version = version
+			s.LowestVersion = version + 1
+			hit = true
+		}
+	}
+
+	// Load events into store, starting from the latest snapshot if not cached
+	load := s.Load
+	if hit {
+		load = s.LoadEvents
+	}
+	if err := load(ctx, id, apply); err != nil {
 		return nil, err
 	}
+	// Only states loaded are cached, as the event dispatched misses the
+	// version, creation time and sequence assigned by the event store
+	if cached {
+		if state, ok := s.State.(proto.Message); ok {
+			cache.Add(aggregator, id, state, s.Version)
+		}
+	}
 
-	// Run validations
-	for _, v := range validations {
-		if err := v(s); err != nil {
+	// Skip commands already processed
+	if key := idempotencyKey(ctx, metadata); key != "" {
+		found, err := s.findIdempotencyKey(ctx, id, key)
+		if err != nil {
 			return nil, err
 		}
+		if found {
+			l.Info().Msgf("command with idempotency key %s already processed by %s", key, id)
+			return s, nil
+		}
+	}
+
+	// Run validations
+	if err := validate(ctx, s, in, validations); err != nil {
+		return nil, err
 	}
 
 	// Encodes input message
@@ -57,21 +117,25 @@ func Aggregate(ctx context.Context, aggregator interface{}, id string, in proto.
 			Metadata: metadata,
 		},
 
+		Priority:   eventPriority(ctx, topic),
 		OriginName: pluto.FromContext(ctx).Name(),
 		OriginIp:   "127.0.0.1",
 	}
 
-	if eid, ok := FromContextAny(ctx, "eid").(string); ok {
-		e.Metadata = map[string]string{"eid": eid}
-	}
+	setContextMetadata(ctx, e)
 
 	// Dispatch event
 	if _, err := s.Dispatch(ctx, e); err != nil {
 		st := status.Convert(err)
 		switch st.Code() {
 		case codes.Aborted:
+			recordMeasures(ctx, map[tag.Key]string{KeySchema: e.Aggregate.GetSchema(), KeyTopic: e.GetTopic()},
+				MAggregateRetries.M(1))
+			if cached {
+				cache.Remove(aggregator, id)
+			}
 			l.Warn().Msgf("event %s with %s version %d  will try again got error %v", e.GetTopic(), e.Aggregate.GetId(), e.Aggregate.GetVersion(), st.Message())
-			return Aggregate(ctx, aggregator, id, in, topic, metadata, apply, validations...)
+			return aggregate(ctx, aggregator, id, in, topic, metadata, apply, validations)
 		default:
 			return nil, err
 		}
@@ -84,3 +148,17 @@ func Aggregate(ctx context.Context, aggregator interface{}, id string, in proto.
 	l.Info().Msg(fmt.Sprintf("state: %v", s.State))
 	return s, nil
 }
+
+// setContextMetadata sets the event id, idempotency key and trace from the
+// context in the event metadata, to be propagated to subscribers
+func setContextMetadata(ctx context.Context, e *pb.Event) {
+	for _, k := range []string{"eid", IdempotencyKeyMetadataKey} {
+		if v, ok := FromContextAny(ctx, k).(string); ok && v != "" {
+			if e.Metadata == nil {
+				e.Metadata = make(map[string]string)
+			}
+			e.Metadata[k] = v
+		}
+	}
+	traceToMetadata(ctx, e)
+}
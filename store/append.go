@@ -0,0 +1,201 @@
+package store
+
+import (
+	"fmt"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+const (
+	// ExpectNotExists expects the aggregate to have no events, to be used
+	// when creating it
+	ExpectNotExists int64 = 0
+	// ExpectAny appends the events whatever the current version of the aggregate
+	ExpectAny int64 = -1
+)
+
+var (
+	// ErrInvalidExpectedVersion is returned by AppendExpected for expected
+	// versions lower than ExpectAny
+	ErrInvalidExpectedVersion = status.Error(codes.InvalidArgument, "invalid expected version")
+
+	errNoEventsToAppend = errors.New("no events to append")
+)
+
+// ConflictError is returned by AppendExpected when the aggregate is not at the
+// expected version. It is converted to a codes.Aborted grpc status
+type ConflictError struct {
+	AggregateID string
+	Expected    int64
+	Actual      int64
+	// Appended number of events appended before the conflict
+	Appended int
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("aggregate %s conflict: expected version %d actual version %d", e.AggregateID, e.Expected, e.Actual)
+}
+
+// GRPCStatus returns the grpc status of the error
+func (e *ConflictError) GRPCStatus() *status.Status {
+	return status.New(codes.Aborted, e.Error())
+}
+
+// NewEvent returns an event with the input message encoded as data, ready
+// to be appended with AppendExpected
+func NewEvent(topic string, in proto.Message) (*pb.Event, error) {
+	data, err := proto.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.Event{
+		Topic: topic,
+
+		Aggregate: &pb.Aggregate{
+			Schema: fmt.Sprintf("%T", in),
+			Format: pb.Aggregate_PROTOBUF,
+			Data:   data,
+		},
+	}, nil
+}
+
+// AppendExpected appends the events to the aggregate only if it is at the
+// expected version, or any version with ExpectAny. It returns the version of
+// the aggregate after the last event appended.
+// Appending several events is not atomic: they are dispatched one by one, so
+// if one of them fails the previous ones remain appended, and the expected
+// version only guards the first one, as another writer may append between
+// them. On a concurrency exception a *ConflictError holding the actual
+// version of the aggregate and the number of events appended is returned, it
+// is up to the caller to retry the events left. With ExpectAny the events
+// left are appended again after the actual version instead.
+// The events are not modified, copies of them are dispatched.
+// Events get the priority set by WithPriority, if any, or else their own one
+// or the priority of their topic if it is 0, see SetTopicPriority
+func AppendExpected(ctx context.Context, id string, expectedVersion int64, events ...*pb.Event) (_ int64, err error) {
+	ctx, span := trace.StartSpan(ctx, "store.AppendExpected")
+	span.AddAttributes(trace.StringAttribute("aggregate_id", id), trace.Int64Attribute("expected_version", expectedVersion))
+	defer func() { endSpan(span, err) }()
+
+	if len(events) == 0 {
+		return 0, errNoEventsToAppend
+	}
+	if expectedVersion < ExpectAny {
+		return 0, ErrInvalidExpectedVersion
+	}
+	version := expectedVersion
+	if version == ExpectAny {
+		if version, err = currentVersion(ctx, id); err != nil {
+			return 0, err
+		}
+	}
+	s := &Store{}
+	for i := 0; i < len(events); {
+		if _, err := s.Dispatch(ctx, appendedEvent(ctx, id, version, events[i])); err != nil {
+			if status.Code(err) != codes.Aborted {
+				return 0, err
+			}
+			actual, verr := currentVersion(ctx, id)
+			if verr != nil {
+				return 0, errors.Wrapf(verr, "aggregate %s conflict at version %d", id, version)
+			}
+			if expectedVersion != ExpectAny {
+				return 0, &ConflictError{AggregateID: id, Expected: version, Actual: actual, Appended: i}
+			}
+			version = actual
+			continue
+		}
+		// The event store assigns the version following the one dispatched
+		version++
+		i++
+	}
+	return version, nil
+}
+
+// appendedEvent returns a copy of the event to be dispatched to the aggregate
+// at the version
+func appendedEvent(ctx context.Context, id string, version int64, in *pb.Event) *pb.Event {
+	e := proto.Clone(in).(*pb.Event)
+	if e.Aggregate == nil {
+		e.Aggregate = &pb.Aggregate{}
+	}
+	e.Aggregate.Id = id
+	e.Aggregate.Version = version
+	// an explicit priority 0 can only be told apart from none by WithPriority
+	if p, ok := contextPriority(ctx); ok {
+		e.Priority = p
+	} else if e.Priority == 0 {
+		e.Priority = eventPriority(ctx, e.GetTopic())
+	}
+	if e.OriginName == "" {
+		e.OriginName = pluto.FromContext(ctx).Name()
+		e.OriginIp = "127.0.0.1"
+	}
+	setContextMetadata(ctx, e)
+	return e
+}
+
+// currentVersion returns the version of the last event of the aggregate.
+// Versions being consecutive, it probes a few of them instead of listing all
+// events, see SearchLast
+func currentVersion(ctx context.Context, id string) (int64, error) {
+	return SearchLast(func(version int64) (bool, error) {
+		return versionExists(ctx, id, version)
+	})
+}
+
+// SearchLast returns the highest n for which exists is true, or 0 if it is
+// false for 1, exists being true for every n from 1 up to it and false after,
+// e.g. for consecutive versions or sequences. Rather than trying every n, it
+// doubles n until exists is false, then searches the last one found between
+// it and the previous n tried
+func SearchLast(exists func(n int64) (bool, error)) (int64, error) {
+	found, missing := int64(0), int64(1)
+	for {
+		ok, err := exists(missing)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			break
+		}
+		found, missing = missing, missing*2
+	}
+	for missing-found > 1 {
+		n := found + (missing-found)/2
+		ok, err := exists(n)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			found = n
+		} else {
+			missing = n
+		}
+	}
+	return found, nil
+}
+
+// versionExists reports if the aggregate has an event at the version
+func versionExists(ctx context.Context, id string, version int64) (bool, error) {
+	it, err := newEventIterator(ctx, EventQuery{
+		AggregateID:    id,
+		LowestVersion:  version,
+		HighestVersion: version,
+		Limit:          1,
+	}, false)
+	if err != nil {
+		return false, err
+	}
+	defer it.Close()
+	ok := it.Next() && it.Event().Aggregate.GetVersion() == version
+	return ok, it.Err()
+}
@@ -0,0 +1,165 @@
+package store_test
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto"
+	"github.com/aukbit/pluto-event-source/eventstore"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/aukbit/pluto-event-source/storetest"
+)
+
+func TestAppendExpected(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	ctx := h.Context()
+	e := storetest.Event("counted", &pb.Aggregate{})
+	v, err := store.AppendExpected(ctx, "1", store.ExpectNotExists, e, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 2 {
+		t.Fatalf("expected version 2 got %d", v)
+	}
+	if v, err = store.AppendExpected(ctx, "1", 2, e); err != nil || v != 3 {
+		t.Fatalf("expected version 3 got %d, %v", v, err)
+	}
+	if e.Aggregate.GetId() != "" || e.Aggregate.GetVersion() != 0 || e.GetOriginName() != "" {
+		t.Fatalf("expected event appended not to be modified got %v", e)
+	}
+	_, err = store.AppendExpected(ctx, "1", 2, e)
+	cerr, ok := err.(*store.ConflictError)
+	if !ok {
+		t.Fatalf("expected *ConflictError got %v", err)
+	}
+	if cerr.Expected != 2 || cerr.Actual != 3 {
+		t.Fatalf("expected conflict at version 2 actual 3 got %v", cerr)
+	}
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("expected %v got %v", codes.Aborted, status.Code(err))
+	}
+	if _, err := store.AppendExpected(ctx, "1", store.ExpectNotExists, e); err == nil {
+		t.Fatal("expected conflict creating an existing aggregate")
+	}
+	if _, err := store.AppendExpected(ctx, "1", -2, e); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected %v got %v", codes.InvalidArgument, err)
+	}
+	if n := len(h.Events("1")); n != 3 {
+		t.Fatalf("expected 3 events appended got %d", n)
+	}
+}
+
+func TestAppendExpectAny(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	ctx := h.Context()
+	e := storetest.Event("counted", &pb.Aggregate{})
+	// the current version is found whatever the number of events
+	for n := 1; n <= 20; n++ {
+		v, err := store.AppendExpected(ctx, "1", store.ExpectAny, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != int64(n) {
+			t.Fatalf("expected version %d got %d", n, v)
+		}
+	}
+}
+
+func TestAppendExpectAnyConcurrent(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx := h.NewContext()
+			e := storetest.Event("counted", &pb.Aggregate{Id: fmt.Sprint(i)})
+			if _, err := store.AppendExpected(ctx, "1", store.ExpectAny, e, e, e); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("expected conflicts to be retried got %v", err)
+	}
+	events := h.Events("1")
+	if len(events) != 30 {
+		t.Fatalf("expected 30 events appended got %d", len(events))
+	}
+	for i, e := range events {
+		if e.Aggregate.GetVersion() != int64(i+1) {
+			t.Fatalf("expected version %d got %d", i+1, e.Aggregate.GetVersion())
+		}
+	}
+}
+
+// racingStore appends an event of another writer right after the first event
+// created
+type racingStore struct {
+	*eventstore.Server
+	once sync.Once
+	err  error
+}
+
+func (s *racingStore) Create(ctx context.Context, e *pb.Event) (*pb.Ack, error) {
+	ack, err := s.Server.Create(ctx, e)
+	s.once.Do(func() {
+		other := &pb.Event{Topic: "counted", Aggregate: &pb.Aggregate{Id: e.Aggregate.GetId(), Version: e.Aggregate.GetVersion() + 1}}
+		_, s.err = s.Server.Create(ctx, other)
+	})
+	return ack, err
+}
+
+func TestAppendExpectedPartial(t *testing.T) {
+	es := &racingStore{Server: eventstore.NewMemory()}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	pb.RegisterEventSourceCommandServer(srv, es)
+	pb.RegisterEventSourceProjectionServer(srv, es.Server)
+	go srv.Serve(lis)
+	defer srv.Stop()
+	ctx := pluto.New(
+		pluto.Name("append"),
+		pluto.Clients(store.NewEventSourceCommandClient(lis.Addr().String())),
+		pluto.Clients(store.NewEventSourceQueryClient(lis.Addr().String())),
+	).WithContext(context.Background())
+
+	// another writer appends between the events, so only the first one is
+	// appended at the expected version
+	e := storetest.Event("counted", &pb.Aggregate{})
+	_, err = store.AppendExpected(ctx, "1", store.ExpectNotExists, e, e, e)
+	if es.err != nil {
+		t.Fatal(es.err)
+	}
+	cerr, ok := err.(*store.ConflictError)
+	if !ok {
+		t.Fatalf("expected *ConflictError got %v", err)
+	}
+	if cerr.Expected != 1 || cerr.Actual != 2 || cerr.Appended != 1 {
+		t.Fatalf("expected conflict after 1 event appended at version 1 actual 2 got %+v", cerr)
+	}
+	events, err := es.Events("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected the first event and the other writer one got %d events", len(events))
+	}
+}
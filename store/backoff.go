@@ -0,0 +1,36 @@
+package store
+
+import (
+	"time"
+
+	"github.com/aukbit/fibonacci"
+)
+
+// backoff returns fibonacci delays in seconds, capped at max
+type backoff struct {
+	f   func() int
+	max time.Duration
+	cur time.Duration
+}
+
+func newBackoff(max time.Duration) *backoff {
+	return &backoff{f: fibonacci.F(), max: max}
+}
+
+// next returns the next delay
+func (b *backoff) next() time.Duration {
+	// stop calling f once capped, as it overflows after a few dozen calls
+	if b.cur < b.max {
+		b.cur = time.Duration(b.f()) * time.Second
+	}
+	if b.cur > b.max {
+		b.cur = b.max
+	}
+	return b.cur
+}
+
+// reset restarts the delays from the first one
+func (b *backoff) reset() {
+	b.f = fibonacci.F()
+	b.cur = 0
+}
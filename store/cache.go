@@ -0,0 +1,96 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// StateCache keeps the latest state loaded, and its version, of the most
+// recently used aggregates, so Aggregate only needs to load events newer than
+// the cached version. It is safe to use concurrently
+type StateCache struct {
+	mu  sync.Mutex
+	lru *simplelru.LRU
+}
+
+// cachedState state of an aggregate at version
+type cachedState struct {
+	state   proto.Message
+	version int64
+}
+
+// NewStateCache returns a cache holding up to size aggregates
+func NewStateCache(size int) (*StateCache, error) {
+	lru, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &StateCache{lru: lru}, nil
+}
+
+// Get returns a copy of the cached state of the aggregate and its version
+func (c *StateCache) Get(aggregator interface{}, id string) (proto.Message, int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.lru.Get(stateCacheKey(aggregator, id))
+	if !ok {
+		return nil, 0, false
+	}
+	cs := v.(cachedState)
+	return proto.Clone(cs.state), cs.version, true
+}
+
+// Add caches a copy of the state of the aggregate at version
+func (c *StateCache) Add(aggregator interface{}, id string, state proto.Message, version int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Add(stateCacheKey(aggregator, id), cachedState{state: proto.Clone(state), version: version})
+}
+
+// Remove invalidates the cached state of the aggregate
+func (c *StateCache) Remove(aggregator interface{}, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Remove(stateCacheKey(aggregator, id))
+}
+
+// Len returns the number of aggregates cached
+func (c *StateCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// stateCacheKey aggregates of different types may share the same id
+func stateCacheKey(aggregator interface{}, id string) string {
+	return fmt.Sprintf("%T/%s", aggregator, id)
+}
+
+// -----------------------------------------------------------------------------
+
+type stateCacheContextKey struct{}
+
+// WithStateCache returns a copy of parent ctx in which Aggregate uses the cache
+func WithStateCache(ctx context.Context, c *StateCache) context.Context {
+	return context.WithValue(ctx, stateCacheContextKey{}, c)
+}
+
+// StateCacheFromContext returns the state cache in ctx, if any
+func StateCacheFromContext(ctx context.Context) (*StateCache, bool) {
+	c, ok := ctx.Value(stateCacheContextKey{}).(*StateCache)
+	return c, ok && c != nil
+}
+
+// StateCacheUnaryServerInterceptor makes the cache available to Aggregate in
+// the context of every unary handler of a pluto grpc server
+func StateCacheUnaryServerInterceptor(c *StateCache) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(WithStateCache(ctx, c), req)
+	}
+}
@@ -0,0 +1,100 @@
+package store_test
+
+import (
+	"testing"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/aukbit/pluto-event-source/storetest"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestStateCacheAggregate(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	cache, err := store.NewStateCache(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := store.WithStateCache(h.Context(), cache)
+	c := &counter{}
+	for i := 0; i < 3; i++ {
+		if _, err := store.Aggregate(ctx, &pb.Aggregate{}, "1", &pb.Aggregate{}, "counted", nil, c.apply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// each command applies the events appended since the state cached and
+	// the event dispatched
+	if c.applied != 5 {
+		t.Fatalf("expected 5 events applied got %d", c.applied)
+	}
+	// the state cached is the state replayed at its version
+	state, version, ok := cache.Get(&pb.Aggregate{}, "1")
+	if !ok {
+		t.Fatal("expected state cached")
+	}
+	s := store.NewStore(&pb.Aggregate{})
+	s.HighestVersion = version
+	if err := s.LoadEvents(h.Context(), "1", c.apply); err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 || s.Version != version || !proto.Equal(state, s.State.(proto.Message)) {
+		t.Fatalf("expected state cached at version %d %v got %d %v", s.Version, s.State, version, state)
+	}
+	if _, _, ok := cache.Get(&pb.Aggregate{}, "2"); ok {
+		t.Fatal("expected aggregate not used not cached")
+	}
+}
+
+func TestStateCacheAborted(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	h.Append("1", storetest.Event("counted", &pb.Aggregate{}), storetest.Event("counted", &pb.Aggregate{}))
+	cache, err := store.NewStateCache(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a stale state ahead of the event store makes the dispatch conflict
+	cache.Add(&pb.Aggregate{}, "1", &pb.Aggregate{Version: 5}, 5)
+	c := &counter{}
+	ctx := store.WithStateCache(h.Context(), cache)
+	if _, err := store.Aggregate(ctx, &pb.Aggregate{}, "1", &pb.Aggregate{}, "counted", nil, c.apply); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(h.Events("1")); n != 3 {
+		t.Fatalf("expected event appended after the conflict got %d events", n)
+	}
+	if _, version, ok := cache.Get(&pb.Aggregate{}, "1"); !ok || version != 2 {
+		t.Fatalf("expected stale state replaced by the state loaded at version 2 got %d", version)
+	}
+}
+
+func TestStateCacheEviction(t *testing.T) {
+	cache, err := store.NewStateCache(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Add(&pb.Aggregate{}, "1", &pb.Aggregate{Id: "1"}, 1)
+	cache.Add(&pb.Event{}, "1", &pb.Aggregate{Id: "event"}, 1)
+	// aggregates of different types do not share a state
+	if state, _, ok := cache.Get(&pb.Aggregate{}, "1"); !ok || state.(*pb.Aggregate).Id != "1" {
+		t.Fatalf("expected state of the aggregate type got %v", state)
+	}
+	cache.Add(&pb.Aggregate{}, "2", &pb.Aggregate{Id: "2"}, 1)
+	if _, _, ok := cache.Get(&pb.Event{}, "1"); ok {
+		t.Fatal("expected least recently used aggregate evicted")
+	}
+	if cache.Len() != 2 {
+		t.Fatalf("expected 2 aggregates cached got %d", cache.Len())
+	}
+	// copies are returned, so the state cached can not be modified
+	state, _, _ := cache.Get(&pb.Aggregate{}, "2")
+	state.(*pb.Aggregate).Id = "modified"
+	if state, _, _ := cache.Get(&pb.Aggregate{}, "2"); state.(*pb.Aggregate).Id != "2" {
+		t.Fatal("expected cached state not modified")
+	}
+	cache.Remove(&pb.Aggregate{}, "2")
+	if _, _, ok := cache.Get(&pb.Aggregate{}, "2"); ok {
+		t.Fatal("expected state removed")
+	}
+}
@@ -0,0 +1,443 @@
+package store
+
+import (
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	context "golang.org/x/net/context"
+
+	"cloud.google.com/go/pubsub"
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto"
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"go.opencensus.io/tag"
+)
+
+const (
+	// CatchUpLabel label of the subscriptions created by CatchUpSubscribe,
+	// holding the sequence of the last event replayed while catching up and
+	// CatchUpDone once caught up
+	CatchUpLabel = "catch_up"
+	// CatchUpDone value of CatchUpLabel once the subscription caught up
+	CatchUpDone = "done"
+	// CatchUpSequenceLabel label holding the sequence of the last event
+	// replayed once the subscription caught up
+	CatchUpSequenceLabel = "catch_up_seq"
+	// CatchUpOwnerLabel label holding the id of the replica catching up
+	CatchUpOwnerLabel = "catch_up_owner"
+	// CatchUpLeaseLabel label holding when the lease of the replica catching
+	// up expires, in unix milliseconds
+	CatchUpLeaseLabel = "catch_up_lease"
+
+	defaultCatchUpMaxBackoff  = time.Minute
+	defaultCatchUpLease       = time.Minute
+	defaultCatchUpTrackerSize = 100000
+	// catchUpCheckpointEvery number of events replayed between checkpoints
+	catchUpCheckpointEvery = 1000
+)
+
+var errCatchUpLeaseLost = errors.New("catch up lease lost to another replica")
+
+// CatchUpMaxBackoff sets the maximum delay between retries of a catch up
+// failing, see CatchUpSubscribe
+func CatchUpMaxBackoff(d time.Duration) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.catchUpMaxBackoff = d
+	}
+}
+
+// CatchUpLease sets the lease of the replica catching up, renewed every third
+// of it while replaying. Other replicas take over once it expires, see
+// CatchUpSubscribe
+func CatchUpLease(d time.Duration) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.catchUpLease = d
+	}
+}
+
+// CatchUpSubscribe subscribes for topics like Subscribe, but before receiving
+// live messages every event of the topics already in the event store is
+// replayed through the same actions.
+// Only subscriptions created by CatchUpSubscribe catch up, so services
+// restarted do not replay the topics again. The subscription is created
+// before the replay starts, so events appended meanwhile are retained by
+// PubSub, and the progress of the replay is kept in its CatchUpLabel so a
+// replay interrupted resumes from the last checkpoint. Events replayed after
+// the last checkpoint are replayed again, so actions must be idempotent.
+// Only the replica holding the lease of the subscription replays, the others
+// wait for it to be done or for its lease to expire, taking over from the
+// last checkpoint. A replica restarted takes over once its previous lease
+// expires. PubSub has no conditional updates, so replicas claiming the lease
+// at once write their id and keep it only if still the owner after a tenth
+// of the lease.
+// Messages of events already replayed are acked without running the actions
+// again, using the sequence of the last event replayed, or the aggregate
+// versions replayed by this process for events without sequence
+func CatchUpSubscribe(client *pubsub.Client, name string, topics Topics, opts ...SubscribeOption) pluto.HookFunc {
+	cfg := newSubscribeConfig(opts...)
+	return func(ctx context.Context) error {
+		l := zerolog.Ctx(ctx)
+		// Set project environment as topic prefix eg. development.event_created
+		env, ok := os.LookupEnv("GCP_PROJECT_ENV")
+		if !ok {
+			return errGcpProjectEnvironmentNotDefined
+		}
+		l.Info().Msgf("catch up and subscribe to topics: %v", topics)
+		sem := cfg.prioritySemaphore()
+		owner := newCatchUpOwner()
+		for t, actions := range topics {
+			// mark the subscription before replaying, so it resumes if interrupted
+			sub, err := subscribeTopic(ctx, client, env, name, t, map[string]string{CatchUpLabel: "0"})
+			if err != nil {
+				return err
+			}
+			c, err := newCatchUp(ctx, sub, owner, t, actions, cfg)
+			if err != nil {
+				return err
+			}
+			go func(c *catchUp, sub *pubsub.Subscription, actions []Action) {
+				var skip func(*pb.Event) bool
+				if c != nil {
+					if err := c.run(ctx); err != nil {
+						return
+					}
+					skip = c.skip
+				}
+				pullMsgsFromSubscription(ctx, sub, actions, skip, cfg, sem)
+			}(c, sub, actions)
+		}
+		return nil
+	}
+}
+
+// newCatchUpOwner returns a random id for the replica catching up
+func newCatchUpOwner() string {
+	return strconv.FormatUint(uint64(rand.Int63()), 36)
+}
+
+// catchUp replays the events of a topic through the actions of a subscription
+type catchUp struct {
+	sub     *pubsub.Subscription
+	topic   string
+	actions []Action
+	cfg     subscribeConfig
+	owner   string
+	// mu guards labels, updated while replaying and renewing the lease
+	mu         sync.Mutex
+	labels     map[string]string
+	replayedTo int64
+	replayed   *versionTracker
+}
+
+// newCatchUp returns the catch up of the subscription, nil if it was not
+// created to catch up
+func newCatchUp(ctx context.Context, sub *pubsub.Subscription, owner, topic string, actions []Action, cfg subscribeConfig) (*catchUp, error) {
+	sc, err := sub.Config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := sc.Labels[CatchUpLabel]; !ok {
+		return nil, nil
+	}
+	return &catchUp{
+		sub:      sub,
+		topic:    topic,
+		actions:  actions,
+		cfg:      cfg,
+		owner:    owner,
+		labels:   sc.Labels,
+		replayed: newVersionTracker(defaultCatchUpTrackerSize),
+	}, nil
+}
+
+// label returns a label of the subscription as last read or updated
+func (c *catchUp) label(k string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.labels[k]
+}
+
+// refresh reads the labels of the subscription
+func (c *catchUp) refresh(ctx context.Context) error {
+	sc, err := c.sub.Config(ctx)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.labels = sc.Labels
+	return nil
+}
+
+// update sets labels of the subscription, removing the ones set empty
+func (c *catchUp) update(ctx context.Context, set map[string]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	labels := make(map[string]string)
+	for k, v := range c.labels {
+		labels[k] = v
+	}
+	for k, v := range set {
+		if v == "" {
+			delete(labels, k)
+			continue
+		}
+		labels[k] = v
+	}
+	if _, err := c.sub.Update(ctx, pubsub.SubscriptionConfigToUpdate{Labels: labels}); err != nil {
+		return err
+	}
+	c.labels = labels
+	return nil
+}
+
+// checkpoint sets the CatchUpLabel of the subscription
+func (c *catchUp) checkpoint(ctx context.Context, value string) error {
+	return c.update(ctx, map[string]string{CatchUpLabel: value})
+}
+
+// lease returns the lease label value expiring one lease from now
+func (c *catchUp) lease() string {
+	return strconv.FormatInt(time.Now().Add(c.cfg.catchUpLease).UnixNano()/int64(time.Millisecond), 10)
+}
+
+// leased reports if the subscription lease is held by another replica
+func (c *catchUp) leased() bool {
+	owner := c.label(CatchUpOwnerLabel)
+	if owner == "" || owner == c.owner {
+		return false
+	}
+	until, err := strconv.ParseInt(c.label(CatchUpLeaseLabel), 10, 64)
+	return err == nil && time.Now().UnixNano()/int64(time.Millisecond) < until
+}
+
+// done reports if the subscription caught up
+func (c *catchUp) done() bool {
+	return c.label(CatchUpLabel) == CatchUpDone
+}
+
+// claim reports if this replica holds the lease to catch up, taking it when
+// free or expired
+func (c *catchUp) claim(ctx context.Context) (bool, error) {
+	if err := c.refresh(ctx); err != nil {
+		return false, err
+	}
+	if c.done() || c.leased() {
+		return false, nil
+	}
+	if err := c.update(ctx, map[string]string{CatchUpOwnerLabel: c.owner, CatchUpLeaseLabel: c.lease()}); err != nil {
+		return false, err
+	}
+	// replicas claiming at once all write their id, the last one wins
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-time.After(c.cfg.catchUpLease / 10):
+	}
+	if err := c.refresh(ctx); err != nil {
+		return false, err
+	}
+	return !c.done() && c.label(CatchUpOwnerLabel) == c.owner, nil
+}
+
+// renew extends the lease while replaying, cancelling the replay if the lease
+// was taken over by another replica
+func (c *catchUp) renew(ctx context.Context, cancel context.CancelFunc, lost *bool) {
+	l := zerolog.Ctx(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.cfg.catchUpLease / 3):
+		}
+		if err := c.refresh(ctx); err != nil {
+			l.Error().Msg(err.Error())
+			continue
+		}
+		if c.label(CatchUpOwnerLabel) != c.owner {
+			*lost = true
+			cancel()
+			return
+		}
+		if err := c.update(ctx, map[string]string{CatchUpLeaseLabel: c.lease()}); err != nil {
+			l.Error().Msg(err.Error())
+		}
+	}
+}
+
+// skip reports if the event was replayed while catching up
+func (c *catchUp) skip(e *pb.Event) bool {
+	if seq, ok := eventSequence(e); ok {
+		return seq <= c.replayedTo
+	}
+	return c.replayed.skip(e)
+}
+
+// run waits for the subscription to catch up, replaying the events while
+// holding its lease. It only fails once ctx is done
+func (c *catchUp) run(ctx context.Context) error {
+	l := zerolog.Ctx(ctx)
+	h := DefaultSubscriptionHealth
+	name := c.sub.ID()
+	b := newBackoff(c.cfg.catchUpMaxBackoff)
+	h.CatchingUp(name)
+	for {
+		owner, err := c.claim(ctx)
+		if err == nil && owner {
+			err = c.replay(ctx)
+		}
+		wait := c.cfg.catchUpLease / 3
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err == errCatchUpLeaseLost:
+			l.Info().Msgf("subscription %s %s", name, err.Error())
+		case err != nil:
+			l.Error().Msg(err.Error())
+			h.BackingOff(name, err)
+			wait = b.next()
+		case c.done():
+			c.replayedTo, _ = strconv.ParseInt(c.label(CatchUpSequenceLabel), 10, 64)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// replay replays every event of the topic through the actions from the last
+// checkpoint, retrying from the last event replayed on failure. The
+// subscription is backing off while retries fail and catching up again once
+// an event is replayed
+func (c *catchUp) replay(ctx context.Context) error {
+	l := zerolog.Ctx(ctx)
+	h := DefaultSubscriptionHealth
+	name := c.sub.ID()
+	after, err := strconv.ParseInt(c.label(CatchUpLabel), 10, 64)
+	if err != nil {
+		return err
+	}
+	rctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lost := false
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.renew(rctx, cancel, &lost)
+	}()
+	// stop renewing before the lease is released or lost
+	stop := func() {
+		cancel()
+		wg.Wait()
+	}
+	b := newBackoff(c.cfg.catchUpMaxBackoff)
+	backingOff := false
+	replayed := 0
+	q := EventQuery{Topics: []string{c.topic}, AfterSequence: after}
+	h.CatchingUp(name)
+	for {
+		err := ForEachEvent(rctx, q, func(e *pb.Event) error {
+			if c.replayed.skip(e) {
+				return nil
+			}
+			tags := map[tag.Key]string{KeySubscription: name, KeySchema: e.Aggregate.GetSchema(), KeyTopic: e.GetTopic()}
+			ectx, span := startSpanFromEvent(updateContext(rctx, e.Metadata["eid"]), "store.CatchUp", e)
+			span.AddAttributes(eventAttributes(e)...)
+			err := runActions(ectx, e, c.actions, tags)
+			endSpan(span, err)
+			if err != nil {
+				return err
+			}
+			c.replayed.set(e)
+			if backingOff {
+				h.CatchingUp(name)
+				b.reset()
+				backingOff = false
+			}
+			seq, ok := eventSequence(e)
+			if !ok {
+				return nil
+			}
+			q.AfterSequence = seq
+			if replayed++; replayed%catchUpCheckpointEvery == 0 {
+				if err := c.checkpoint(rctx, strconv.FormatInt(seq, 10)); err != nil {
+					l.Error().Msg(err.Error())
+				}
+			}
+			return nil
+		})
+		if rctx.Err() != nil {
+			stop()
+			if lost {
+				return errCatchUpLeaseLost
+			}
+			return ctx.Err()
+		}
+		if err == nil {
+			stop()
+			err = c.update(ctx, map[string]string{
+				CatchUpLabel:         CatchUpDone,
+				CatchUpSequenceLabel: strconv.FormatInt(q.AfterSequence, 10),
+				CatchUpOwnerLabel:    "",
+				CatchUpLeaseLabel:    "",
+			})
+			if err != nil {
+				return err
+			}
+			l.Info().Msgf("subscription %s caught up with topic %s", name, c.topic)
+			return nil
+		}
+		l.Error().Msg(err.Error())
+		h.BackingOff(name, err)
+		backingOff = true
+		select {
+		case <-rctx.Done():
+		case <-time.After(b.next()):
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// versionTracker keeps the highest version replayed of the most recently
+// replayed aggregates. Messages of aggregates evicted are not detected as
+// replayed, so their actions may run twice
+type versionTracker struct {
+	mu  sync.Mutex
+	lru *simplelru.LRU
+}
+
+func newVersionTracker(size int) *versionTracker {
+	lru, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		panic(err)
+	}
+	return &versionTracker{lru: lru}
+}
+
+func (t *versionTracker) set(e *pb.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id := e.Aggregate.GetId()
+	if v, ok := t.lru.Peek(id); ok && e.Aggregate.GetVersion() <= v.(int64) {
+		return
+	}
+	t.lru.Add(id, e.Aggregate.GetVersion())
+}
+
+// skip reports if the event version was already replayed
+func (t *versionTracker) skip(e *pb.Event) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, ok := t.lru.Get(e.Aggregate.GetId())
+	return ok && e.Aggregate.GetVersion() <= v.(int64)
+}
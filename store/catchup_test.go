@@ -0,0 +1,208 @@
+package store_test
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	context "golang.org/x/net/context"
+
+	"cloud.google.com/go/pubsub"
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto-event-source/pubsubtest"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/aukbit/pluto-event-source/storetest"
+)
+
+// catchUpSubscribe runs CatchUpSubscribe as a new replica against the event
+// store and the PubSub of the harnesses, until the returned func is called
+func catchUpSubscribe(t *testing.T, sh *storetest.Harness, ps *pubsubtest.Harness, topics store.Topics, opts ...store.SubscribeOption) func() {
+	t.Helper()
+	ctx, cancel := context.WithCancel(sh.NewContext())
+	opts = append([]store.SubscribeOption{store.CatchUpLease(300 * time.Millisecond)}, opts...)
+	if err := store.CatchUpSubscribe(ps.Client(), "billing", topics, opts...)(ctx); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	return cancel
+}
+
+func TestCatchUpSubscribe(t *testing.T) {
+	prev := store.DefaultSubscriptionHealth
+	store.DefaultSubscriptionHealth = store.NewSubscriptionHealth()
+	defer func() { store.DefaultSubscriptionHealth = prev }()
+	h := store.DefaultSubscriptionHealth
+
+	sh := storetest.New(t)
+	defer sh.Close()
+	ps := pubsubtest.New(t)
+	defer ps.Close()
+	sh.Append("1", storetest.Event("counted", &pb.Aggregate{}), storetest.Event("counted", &pb.Aggregate{}))
+	sh.Append("2", storetest.Event("counted", &pb.Aggregate{}))
+	name := store.SubscriptionName(os.Getenv("GCP_PROJECT_ENV"), "billing", "counted")
+
+	r := pubsubtest.Record(nil)
+	stop := catchUpSubscribe(t, sh, ps, store.Topics{"counted": {r.Action}})
+	ps.WaitAcked(r, append(sh.Events("1"), sh.Events("2")...)...)
+	waitFor(t, func() bool {
+		st, _ := subscriptionStatus(h, name)
+		return st.State == store.SubscriptionRunning
+	})
+	cfg, err := ps.Client().Subscription(name).Config(ps.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Labels[store.CatchUpLabel] != store.CatchUpDone {
+		t.Fatalf("expected subscription caught up got label %q", cfg.Labels[store.CatchUpLabel])
+	}
+	// live events are received once caught up
+	live := storetest.Event("counted", &pb.Aggregate{})
+	live.Aggregate.Id, live.Aggregate.Version = "3", 1
+	ps.Publish(live)
+	ps.WaitAcked(r, live)
+	stop()
+	waitFor(t, func() bool {
+		st, _ := subscriptionStatus(h, name)
+		return st.State == store.SubscriptionStopped
+	})
+
+	// a restarted service does not catch up again
+	restarted := pubsubtest.Record(nil)
+	stop = catchUpSubscribe(t, sh, ps, store.Topics{"counted": {restarted.Action}})
+	defer stop()
+	waitFor(t, func() bool {
+		st, _ := subscriptionStatus(h, name)
+		return st.State == store.SubscriptionRunning
+	})
+	if got := restarted.Acked(); len(got) != 0 {
+		t.Fatalf("expected no events replayed after restart got %d", len(got))
+	}
+}
+
+func TestCatchUpBackingOff(t *testing.T) {
+	prev := store.DefaultSubscriptionHealth
+	store.DefaultSubscriptionHealth = store.NewSubscriptionHealth()
+	defer func() { store.DefaultSubscriptionHealth = prev }()
+	h := store.DefaultSubscriptionHealth
+
+	sh := storetest.New(t)
+	defer sh.Close()
+	ps := pubsubtest.New(t)
+	defer ps.Close()
+	sh.Append("1", storetest.Event("counted", &pb.Aggregate{}), storetest.Event("counted", &pb.Aggregate{}))
+	name := store.SubscriptionName(os.Getenv("GCP_PROJECT_ENV"), "billing", "counted")
+
+	var failing int32 = 1
+	r := pubsubtest.Record(func(ctx context.Context, e *pb.Event) error {
+		if atomic.LoadInt32(&failing) == 1 {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	stop := catchUpSubscribe(t, sh, ps, store.Topics{"counted": {r.Action}}, store.CatchUpMaxBackoff(10*time.Millisecond))
+	defer stop()
+	var first store.SubscriptionStatus
+	waitFor(t, func() bool {
+		first, _ = subscriptionStatus(h, name)
+		return first.State == store.SubscriptionBackingOff
+	})
+	// retries failing keep the time the catch up started backing off
+	waitFor(t, func() bool { return len(r.Nacked()) >= 3 })
+	st, _ := subscriptionStatus(h, name)
+	if st.State != store.SubscriptionBackingOff || !st.Since.Equal(first.Since) {
+		t.Fatalf("expected backing off since %v got %s since %v", first.Since, st.State, st.Since)
+	}
+	atomic.StoreInt32(&failing, 0)
+	ps.WaitAcked(r, sh.Events("1")...)
+	waitFor(t, func() bool {
+		st, _ := subscriptionStatus(h, name)
+		return st.State == store.SubscriptionRunning
+	})
+}
+
+func TestCatchUpSubscribeReplicas(t *testing.T) {
+	prev := store.DefaultSubscriptionHealth
+	store.DefaultSubscriptionHealth = store.NewSubscriptionHealth()
+	defer func() { store.DefaultSubscriptionHealth = prev }()
+	h := store.DefaultSubscriptionHealth
+
+	sh := storetest.New(t)
+	defer sh.Close()
+	ps := pubsubtest.New(t)
+	defer ps.Close()
+	sh.Append("1", storetest.Event("counted", &pb.Aggregate{}), storetest.Event("counted", &pb.Aggregate{}))
+	sh.Append("2", storetest.Event("counted", &pb.Aggregate{}))
+	replayed := append(sh.Events("1"), sh.Events("2")...)
+	name := store.SubscriptionName(os.Getenv("GCP_PROJECT_ENV"), "billing", "counted")
+
+	r1, r2 := pubsubtest.Record(nil), pubsubtest.Record(nil)
+	stop1 := catchUpSubscribe(t, sh, ps, store.Topics{"counted": {r1.Action}})
+	defer stop1()
+	stop2 := catchUpSubscribe(t, sh, ps, store.Topics{"counted": {r2.Action}})
+	defer stop2()
+	waitFor(t, func() bool { return len(r1.Acked())+len(r2.Acked()) >= len(replayed) })
+	waitFor(t, func() bool {
+		st, _ := subscriptionStatus(h, name)
+		return st.State == store.SubscriptionRunning
+	})
+	cfg, err := ps.Client().Subscription(name).Config(ps.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Labels[store.CatchUpLabel] != store.CatchUpDone || cfg.Labels[store.CatchUpOwnerLabel] != "" {
+		t.Fatalf("expected subscription caught up and released got labels %v", cfg.Labels)
+	}
+	if n1, n2 := len(r1.Acked()), len(r2.Acked()); n1 != 0 && n2 != 0 {
+		t.Fatalf("expected a single replica replaying got %d and %d events", n1, n2)
+	}
+	// messages of events replayed are acked by either replica without
+	// running the actions again
+	ps.Publish(replayed...)
+	live := storetest.Event("counted", &pb.Aggregate{})
+	live.Aggregate.Id, live.Aggregate.Version = "3", 1
+	ps.Publish(live)
+	waitFor(t, func() bool { return len(r1.Acked())+len(r2.Acked()) > len(replayed) })
+	waitFor(t, func() bool { return ps.Server().Outstanding(name) == 0 })
+	if got := len(r1.Acked()) + len(r2.Acked()); got != len(replayed)+1 {
+		t.Fatalf("expected %d events handled once got %d", len(replayed)+1, got)
+	}
+}
+
+func TestCatchUpLeaseExpired(t *testing.T) {
+	prev := store.DefaultSubscriptionHealth
+	store.DefaultSubscriptionHealth = store.NewSubscriptionHealth()
+	defer func() { store.DefaultSubscriptionHealth = prev }()
+
+	sh := storetest.New(t)
+	defer sh.Close()
+	ps := pubsubtest.New(t)
+	defer ps.Close()
+	sh.Append("1", storetest.Event("counted", &pb.Aggregate{}), storetest.Event("counted", &pb.Aggregate{}))
+	name := store.SubscriptionName(os.Getenv("GCP_PROJECT_ENV"), "billing", "counted")
+
+	// a replica restarted while catching up left its lease behind, expiring
+	// shortly
+	topic, err := store.GetOrCreateTopic(ps.Context(), ps.Client(), "counted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease := strconv.FormatInt(time.Now().Add(200*time.Millisecond).UnixNano()/int64(time.Millisecond), 10)
+	_, err = ps.Client().CreateSubscription(ps.Context(), name, pubsub.SubscriptionConfig{
+		Topic:  topic,
+		Labels: map[string]string{store.CatchUpLabel: "0", store.CatchUpOwnerLabel: "gone", store.CatchUpLeaseLabel: lease},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := pubsubtest.Record(nil)
+	stop := catchUpSubscribe(t, sh, ps, store.Topics{"counted": {r.Action}})
+	defer stop()
+	time.Sleep(100 * time.Millisecond)
+	if got := r.Acked(); len(got) != 0 {
+		t.Fatalf("expected no events replayed while leased got %d", len(got))
+	}
+	ps.WaitAcked(r, sh.Events("1")...)
+}
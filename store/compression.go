@@ -0,0 +1,128 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+const (
+	// CompressionMetadataKey constant to be used as the key in Aggregate Metadata
+	// holding the codec the data is compressed with
+	CompressionMetadataKey string = "compression"
+
+	// DefaultCompressionThreshold is the data size in bytes from which data is
+	// compressed
+	DefaultCompressionThreshold = 1024
+
+	compressionGzip = "gzip"
+)
+
+var (
+	errCompressionNotSupported = errors.New("compression not supported")
+)
+
+// Compression defines how aggregate data is compressed. Only gzip is
+// available, at any of its levels, e.g. gzip.BestSpeed
+type Compression struct {
+	// Level gzip compression level, 0 meaning gzip.DefaultCompression as
+	// storing data uncompressed is done by not defining a compression
+	Level int
+	// Threshold data size in bytes below which data is stored raw
+	Threshold int
+}
+
+// DefaultCompression enables the compression of the aggregate data of every
+// event and snapshot dispatched when defined. It must be set before the
+// service starts
+//
+//	store.DefaultCompression = &store.Compression{
+//		Level:     gzip.BestSpeed,
+//		Threshold: store.DefaultCompressionThreshold,
+//	}
+var DefaultCompression *Compression
+
+// compressEvent returns a copy of the event with the aggregate data compressed,
+// or the event itself if compression is disabled or data is below threshold
+func compressEvent(e *pb.Event) (*pb.Event, error) {
+	c := DefaultCompression
+	if c == nil || len(e.GetAggregate().GetData()) < c.Threshold {
+		return e, nil
+	}
+	if _, ok := e.Aggregate.Metadata[CompressionMetadataKey]; ok {
+		return e, nil
+	}
+	level := c.Level
+	if level == gzip.NoCompression {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(e.Aggregate.Data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	e = proto.Clone(e).(*pb.Event)
+	e.Aggregate.Data = buf.Bytes()
+	if e.Aggregate.Metadata == nil {
+		e.Aggregate.Metadata = make(map[string]string)
+	}
+	e.Aggregate.Metadata[CompressionMetadataKey] = compressionGzip
+	return e, nil
+}
+
+// decompressEvent returns a copy of the event with the aggregate data
+// decompressed, or the event itself if it is not compressed
+func decompressEvent(e *pb.Event) (*pb.Event, error) {
+	codec, ok := e.GetAggregate().GetMetadata()[CompressionMetadataKey]
+	if !ok {
+		return e, nil
+	}
+	if codec != compressionGzip {
+		return nil, errors.Wrap(errCompressionNotSupported, codec)
+	}
+	e = proto.Clone(e).(*pb.Event)
+	delete(e.Aggregate.Metadata, CompressionMetadataKey)
+	// redacted data has nothing left to decompress
+	if IsRedacted(e) {
+		return e, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(e.Aggregate.Data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if e.Aggregate.Data, err = ioutil.ReadAll(r); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// encodeEvent compresses and then encrypts the aggregate data as configured
+func encodeEvent(ctx context.Context, e *pb.Event) (*pb.Event, error) {
+	e, err := compressEvent(e)
+	if err != nil {
+		return nil, err
+	}
+	return encryptEvent(ctx, e)
+}
+
+// decodeEvent reverts encodeEvent
+func decodeEvent(ctx context.Context, e *pb.Event) (*pb.Event, error) {
+	e, err := decryptEvent(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	return decompressEvent(e)
+}
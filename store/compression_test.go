@@ -0,0 +1,94 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/golang/protobuf/proto"
+)
+
+// withCompression sets the default compression until the returned func is called
+func withCompression(c *Compression) func() {
+	prev := DefaultCompression
+	DefaultCompression = c
+	return func() { DefaultCompression = prev }
+}
+
+func largeEvent(id string) (*pb.Event, *pb.Aggregate) {
+	in := &pb.Aggregate{Id: id, Data: bytes.Repeat([]byte("event source "), 200)}
+	return dataEvent(id, in), in
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	for _, level := range []int{0, gzip.BestSpeed, gzip.BestCompression} {
+		restore := withCompression(&Compression{Level: level, Threshold: DefaultCompressionThreshold})
+		e, in := largeEvent("1")
+		enc, err := encodeEvent(context.Background(), e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enc.Aggregate.Metadata[CompressionMetadataKey] != compressionGzip {
+			t.Fatalf("level %d: expected data compressed got metadata %v", level, enc.Aggregate.Metadata)
+		}
+		if len(enc.Aggregate.Data) >= len(e.Aggregate.Data) {
+			t.Fatalf("level %d: expected data compressed to less than %d bytes got %d", level, len(e.Aggregate.Data), len(enc.Aggregate.Data))
+		}
+		out := &pb.Aggregate{}
+		if err := UnmarshalEventData(enc, out); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(out, in) {
+			t.Fatalf("level %d: expected %v got %v", level, in, out)
+		}
+		restore()
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	defer withCompression(&Compression{Threshold: DefaultCompressionThreshold})()
+	e := dataEvent("1", &pb.Aggregate{Id: "small"})
+	enc, err := encodeEvent(context.Background(), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc != e {
+		t.Fatal("expected data below threshold stored raw")
+	}
+}
+
+func TestCompressionEncrypted(t *testing.T) {
+	defer withCompression(&Compression{Threshold: DefaultCompressionThreshold})()
+	defer withKeyStore(NewMemoryKeyStore())()
+	ctx := context.Background()
+	e, in := largeEvent("1")
+	enc, err := encodeEvent(ctx, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := enc.Aggregate.Metadata
+	if md[CompressionMetadataKey] != compressionGzip || md[EncryptionMetadataKey] != encryptionAES256GCM {
+		t.Fatalf("expected data compressed and encrypted got metadata %v", md)
+	}
+	out := &pb.Aggregate{}
+	if err := UnmarshalEventDataContext(ctx, enc, out); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(out, in) {
+		t.Fatalf("expected %v got %v", in, out)
+	}
+	// redacted data is not decompressed
+	if err := Forget(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	dec, err := decodeEvent(ctx, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsRedacted(dec) {
+		t.Fatal("expected event redacted")
+	}
+}
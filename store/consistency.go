@@ -0,0 +1,101 @@
+package store
+
+import (
+	"fmt"
+
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/rs/zerolog"
+	"go.opencensus.io/tag"
+)
+
+// ReplayMode defines how version inconsistencies found while replaying the
+// events of an aggregate are handled
+type ReplayMode int
+
+const (
+	// ReplayLenient logs and records inconsistencies, events are still applied
+	ReplayLenient ReplayMode = iota
+	// ReplayStrict stops the replay returning a *CorruptionError
+	ReplayStrict
+)
+
+type replayModeContextKey struct{}
+
+// WithReplayMode returns a copy of parent ctx in which events are replayed in
+// the mode, overriding the Mode of the store, so Aggregate and the load
+// functions of stores built by NewStore can be strict
+func WithReplayMode(ctx context.Context, mode ReplayMode) context.Context {
+	return context.WithValue(ctx, replayModeContextKey{}, mode)
+}
+
+// contextReplayMode returns the mode set by WithReplayMode, if any
+func contextReplayMode(ctx context.Context) (ReplayMode, bool) {
+	m, ok := ctx.Value(replayModeContextKey{}).(ReplayMode)
+	return m, ok
+}
+
+// CorruptionError is returned in strict mode when the events of an aggregate
+// are not strictly consecutive: a version is missing, duplicated or out of order
+type CorruptionError struct {
+	AggregateID string
+	Expected    int64
+	Got         int64
+}
+
+func (e *CorruptionError) Error() string {
+	kind := "gap"
+	if e.Got < e.Expected {
+		kind = "duplicated or out of order version"
+	}
+	return fmt.Sprintf("aggregate %s corrupted: %s, expected version %d got %d", e.AggregateID, kind, e.Expected, e.Got)
+}
+
+// versionChecker validates events are replayed in consecutive versions
+type versionChecker struct {
+	id       string
+	mode     ReplayMode
+	schema   string
+	expected int64
+}
+
+// newVersionChecker returns a checker expecting the version following the
+// current store version, if loaded from a snapshot or cache, or LowestVersion
+func (s *Store) newVersionChecker(ctx context.Context, id string) *versionChecker {
+	expected := int64(1)
+	switch {
+	case s.Version > 0:
+		expected = s.Version + 1
+	case s.LowestVersion > 0:
+		expected = s.LowestVersion
+	}
+	mode := s.Mode
+	if m, ok := contextReplayMode(ctx); ok {
+		mode = m
+	}
+	return &versionChecker{
+		id:       id,
+		mode:     mode,
+		schema:   fmt.Sprintf("%T", s.State),
+		expected: expected,
+	}
+}
+
+// check validates the event version, in lenient mode it never fails
+func (c *versionChecker) check(ctx context.Context, e *pb.Event) error {
+	got := e.Aggregate.GetVersion()
+	if got == c.expected {
+		c.expected++
+		return nil
+	}
+	err := &CorruptionError{AggregateID: c.id, Expected: c.expected, Got: got}
+	recordMeasures(ctx, map[tag.Key]string{KeySchema: c.schema}, MVersionInconsistencies.M(1))
+	if c.mode == ReplayStrict {
+		return err
+	}
+	l := zerolog.Ctx(ctx)
+	l.Warn().Msg(err.Error())
+	c.expected = got + 1
+	return nil
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"testing"
+
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+)
+
+func versionEvent(v int64) *pb.Event {
+	return &pb.Event{Aggregate: &pb.Aggregate{Id: "1", Version: v}}
+}
+
+func TestVersionCheckerStrict(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name     string
+		versions []int64
+		expected int64
+		got      int64
+	}{
+		{"gap", []int64{1, 2, 4}, 3, 4},
+		{"duplicated", []int64{1, 2, 2}, 3, 2},
+		{"out of order", []int64{2, 1}, 1, 2},
+	} {
+		s := &Store{Mode: ReplayStrict}
+		vc := s.newVersionChecker(ctx, "1")
+		var err error
+		for _, v := range tc.versions {
+			if err = vc.check(ctx, versionEvent(v)); err != nil {
+				break
+			}
+		}
+		cerr, ok := err.(*CorruptionError)
+		if !ok {
+			t.Fatalf("%s: expected *CorruptionError got %v", tc.name, err)
+		}
+		if cerr.Expected != tc.expected || cerr.Got != tc.got {
+			t.Fatalf("%s: expected version %d got %d, error %v", tc.name, tc.expected, tc.got, cerr)
+		}
+	}
+}
+
+func TestVersionCheckerLenient(t *testing.T) {
+	ctx := context.Background()
+	vc := (&Store{}).newVersionChecker(ctx, "1")
+	for _, v := range []int64{1, 3, 3, 4} {
+		if err := vc.check(ctx, versionEvent(v)); err != nil {
+			t.Fatalf("expected lenient check not to fail got %v", err)
+		}
+	}
+	if vc.expected != 5 {
+		t.Fatalf("expected to continue after the last version got %d", vc.expected)
+	}
+}
+
+func TestVersionCheckerStart(t *testing.T) {
+	ctx := context.Background()
+	// loaded from a snapshot or cache at version 5
+	s := &Store{Mode: ReplayStrict, Version: 5, LowestVersion: 6}
+	if err := s.newVersionChecker(ctx, "1").check(ctx, versionEvent(6)); err != nil {
+		t.Fatalf("expected version following the state got %v", err)
+	}
+	// loading a range of versions
+	s = &Store{Mode: ReplayStrict, LowestVersion: 3}
+	if err := s.newVersionChecker(ctx, "1").check(ctx, versionEvent(3)); err != nil {
+		t.Fatalf("expected lowest version got %v", err)
+	}
+	if err := (&Store{Mode: ReplayStrict}).newVersionChecker(ctx, "1").check(ctx, versionEvent(2)); err == nil {
+		t.Fatal("expected first version to be 1")
+	}
+}
+
+func TestVersionCheckerContextMode(t *testing.T) {
+	ctx := WithReplayMode(context.Background(), ReplayStrict)
+	if err := (&Store{}).newVersionChecker(ctx, "1").check(ctx, versionEvent(2)); err == nil {
+		t.Fatal("expected strict mode set in the context")
+	}
+	ctx = WithReplayMode(context.Background(), ReplayLenient)
+	if err := (&Store{Mode: ReplayStrict}).newVersionChecker(ctx, "1").check(ctx, versionEvent(2)); err != nil {
+		t.Fatalf("expected context mode to override the store got %v", err)
+	}
+}
@@ -68,3 +68,14 @@ func updateContext(ctx context.Context, eid string) context.Context {
 	// update context with new logger
 	return sublogger.WithContext(ctx)
 }
+
+func toIncomingContext(ctx context.Context, key string, value string) context.Context {
+	// replace key in incoming context
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		md = metadata.New(map[string]string{})
+	}
+	md = md.Copy()
+	md[key] = []string{value}
+	return metadata.NewIncomingContext(ctx, md)
+}
@@ -0,0 +1,191 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"sync"
+
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+const (
+	// EncryptionMetadataKey constant to be used as the key in Aggregate Metadata
+	// holding the algorithm the data is encrypted with
+	EncryptionMetadataKey string = "encryption"
+
+	// RedactedMetadataKey constant to be used as the key in Aggregate Metadata
+	// of events whose data key has been forgotten
+	RedactedMetadataKey string = "redacted"
+
+	encryptionAES256GCM = "aes-256-gcm"
+	dataKeySize         = 32
+)
+
+var (
+	// ErrKeyForgotten is returned by a key store for aggregates forgotten
+	ErrKeyForgotten = errors.New("data key forgotten")
+
+	errEncryptionNotSupported = errors.New("encryption not supported")
+	errInvalidCiphertext      = errors.New("invalid ciphertext")
+	errKeyStoreNotDefined     = errors.New("key store not defined")
+)
+
+// KeyStore keeps a data key per aggregate. Implementations backed by a KMS
+// should store the data keys wrapped by a master key
+type KeyStore interface {
+	// DataKey returns the data key of the aggregate, creating it if it does not
+	// exist, or ErrKeyForgotten if it has been forgotten
+	DataKey(ctx context.Context, id string) ([]byte, error)
+	// Forget destroys the data key of the aggregate
+	Forget(ctx context.Context, id string) error
+}
+
+// DefaultKeyStore enables the encryption of the aggregate data of every event
+// and snapshot dispatched when defined. It must be set before the service
+// starts
+var DefaultKeyStore KeyStore
+
+// Forget destroys the data key of the aggregate, from then on the data of its
+// events and snapshots is replayed redacted
+func Forget(ctx context.Context, id string) error {
+	if DefaultKeyStore == nil {
+		return errKeyStoreNotDefined
+	}
+	return DefaultKeyStore.Forget(ctx, id)
+}
+
+// IsRedacted reports if the event data has been redacted because the data key
+// of the aggregate was forgotten
+func IsRedacted(e *pb.Event) bool {
+	return e.GetAggregate().GetMetadata()[RedactedMetadataKey] == "true"
+}
+
+// encryptEvent returns a copy of the event with the aggregate data encrypted
+// with the data key of the aggregate, or the event itself if there is no key
+// store defined
+func encryptEvent(ctx context.Context, e *pb.Event) (*pb.Event, error) {
+	if DefaultKeyStore == nil || e.GetAggregate() == nil {
+		return e, nil
+	}
+	if _, ok := e.Aggregate.Metadata[EncryptionMetadataKey]; ok {
+		return e, nil
+	}
+	key, err := DefaultKeyStore.DataKey(ctx, e.Aggregate.GetId())
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	e = proto.Clone(e).(*pb.Event)
+	// the aggregate id is authenticated so data can not be moved between aggregates
+	e.Aggregate.Data = gcm.Seal(nonce, nonce, e.Aggregate.Data, []byte(e.Aggregate.Id))
+	if e.Aggregate.Metadata == nil {
+		e.Aggregate.Metadata = make(map[string]string)
+	}
+	e.Aggregate.Metadata[EncryptionMetadataKey] = encryptionAES256GCM
+	return e, nil
+}
+
+// decryptEvent returns a copy of the event with the aggregate data decrypted,
+// or redacted if the data key was forgotten, or the event itself if it is not
+// encrypted
+func decryptEvent(ctx context.Context, e *pb.Event) (*pb.Event, error) {
+	alg, ok := e.GetAggregate().GetMetadata()[EncryptionMetadataKey]
+	if !ok {
+		return e, nil
+	}
+	if alg != encryptionAES256GCM {
+		return nil, errors.Wrap(errEncryptionNotSupported, alg)
+	}
+	if DefaultKeyStore == nil {
+		return nil, errKeyStoreNotDefined
+	}
+	e = proto.Clone(e).(*pb.Event)
+	delete(e.Aggregate.Metadata, EncryptionMetadataKey)
+	key, err := DefaultKeyStore.DataKey(ctx, e.Aggregate.GetId())
+	if err == ErrKeyForgotten {
+		e.Aggregate.Data = nil
+		e.Aggregate.Metadata[RedactedMetadataKey] = "true"
+		return e, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	data := e.Aggregate.Data
+	if len(data) < gcm.NonceSize() {
+		return nil, errInvalidCiphertext
+	}
+	if e.Aggregate.Data, err = gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(e.Aggregate.Id)); err != nil {
+		return nil, errors.Wrap(errInvalidCiphertext, err.Error())
+	}
+	return e, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// -----------------------------------------------------------------------------
+
+// MemoryKeyStore is an in-memory key store, keys are lost when the process
+// exits so it should only be used in tests
+type MemoryKeyStore struct {
+	mu        sync.Mutex
+	keys      map[string][]byte
+	forgotten map[string]bool
+}
+
+// NewMemoryKeyStore returns an empty in-memory key store
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{
+		keys:      make(map[string][]byte),
+		forgotten: make(map[string]bool),
+	}
+}
+
+// DataKey implements KeyStore
+func (m *MemoryKeyStore) DataKey(ctx context.Context, id string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.forgotten[id] {
+		return nil, ErrKeyForgotten
+	}
+	if key, ok := m.keys[id]; ok {
+		return key, nil
+	}
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	m.keys[id] = key
+	return key, nil
+}
+
+// Forget implements KeyStore
+func (m *MemoryKeyStore) Forget(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keys, id)
+	m.forgotten[id] = true
+	return nil
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/golang/protobuf/proto"
+)
+
+// withKeyStore sets the default key store until the returned func is called
+func withKeyStore(ks KeyStore) func() {
+	prev := DefaultKeyStore
+	DefaultKeyStore = ks
+	return func() { DefaultKeyStore = prev }
+}
+
+func dataEvent(id string, in proto.Message) *pb.Event {
+	e, err := NewEvent("counted", in)
+	if err != nil {
+		panic(err)
+	}
+	e.Aggregate.Id = id
+	return e
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	defer withKeyStore(NewMemoryKeyStore())()
+	ctx := context.Background()
+	in := &pb.Aggregate{Id: "secret"}
+	e := dataEvent("1", in)
+	enc, err := encodeEvent(ctx, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc.Aggregate.Metadata[EncryptionMetadataKey] != encryptionAES256GCM {
+		t.Fatalf("expected event encrypted got metadata %v", enc.Aggregate.Metadata)
+	}
+	if bytes.Equal(enc.Aggregate.Data, e.Aggregate.Data) {
+		t.Fatal("expected data encrypted")
+	}
+	if e.Aggregate.Metadata[EncryptionMetadataKey] != "" {
+		t.Fatal("expected event encoded not to be modified")
+	}
+	out := &pb.Aggregate{}
+	if err := UnmarshalEventDataContext(ctx, enc, out); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(out, in) {
+		t.Fatalf("expected %v got %v", in, out)
+	}
+	// data is bound to its aggregate
+	moved := proto.Clone(enc).(*pb.Event)
+	moved.Aggregate.Id = "2"
+	if _, err := decodeEvent(ctx, moved); err == nil {
+		t.Fatal("expected data moved to another aggregate not to decrypt")
+	}
+}
+
+func TestEncryptionForget(t *testing.T) {
+	defer withKeyStore(NewMemoryKeyStore())()
+	ctx := context.Background()
+	enc, err := encodeEvent(ctx, dataEvent("1", &pb.Aggregate{Id: "secret"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Forget(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	dec, err := decodeEvent(ctx, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsRedacted(dec) || len(dec.Aggregate.Data) != 0 {
+		t.Fatalf("expected event redacted got %v", dec.Aggregate)
+	}
+	out := &pb.Aggregate{}
+	if err := UnmarshalEventData(enc, out); err != nil || out.Id != "" {
+		t.Fatalf("expected redacted data unmarshalled as empty got %v, %v", out, err)
+	}
+}
+
+type ctxKey struct{}
+
+// contextKeyStore records the context value of the calls to DataKey
+type contextKeyStore struct {
+	*MemoryKeyStore
+	values []interface{}
+}
+
+func (ks *contextKeyStore) DataKey(ctx context.Context, id string) ([]byte, error) {
+	ks.values = append(ks.values, ctx.Value(ctxKey{}))
+	return ks.MemoryKeyStore.DataKey(ctx, id)
+}
+
+func TestUnmarshalEventDataContext(t *testing.T) {
+	ks := &contextKeyStore{MemoryKeyStore: NewMemoryKeyStore()}
+	defer withKeyStore(ks)()
+	ctx := context.WithValue(context.Background(), ctxKey{}, "caller")
+	enc, err := encodeEvent(ctx, dataEvent("1", &pb.Aggregate{Id: "secret"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := UnmarshalEventDataContext(ctx, enc, &pb.Aggregate{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ks.values) != 2 || ks.values[1] != "caller" {
+		t.Fatalf("expected key store called with the caller context got %v", ks.values)
+	}
+}
+
+func TestDecodeNotEncrypted(t *testing.T) {
+	e := dataEvent("1", &pb.Aggregate{Id: "plain"})
+	dec, err := decodeEvent(context.Background(), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec != e {
+		t.Fatal("expected event not encoded to be returned as is")
+	}
+}
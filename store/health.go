@@ -0,0 +1,191 @@
+package store
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aukbit/pluto/reply"
+	"github.com/aukbit/pluto/server"
+	"github.com/aukbit/pluto/server/router"
+	"github.com/pkg/errors"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	// SubscriptionsServerName constant to be used as name of the pluto server
+	// reporting subscriptions health
+	SubscriptionsServerName string = "subscriptions"
+
+	// DefaultMaxBackoff is how long a subscription may keep failing before
+	// being reported as not serving
+	DefaultMaxBackoff = time.Minute
+)
+
+var (
+	errSubscriptionNotFound = errors.New("subscription not found")
+)
+
+// SubscriptionState state of a subscription consumer
+type SubscriptionState string
+
+// Subscription states
+const (
+	SubscriptionCatchingUp SubscriptionState = "catching_up"
+	SubscriptionRunning    SubscriptionState = "running"
+	SubscriptionBackingOff SubscriptionState = "backing_off"
+	SubscriptionStopped    SubscriptionState = "stopped"
+)
+
+// SubscriptionStatus holds the current status of a subscription consumer
+type SubscriptionStatus struct {
+	Name  string            `json:"name"`
+	State SubscriptionState `json:"state"`
+	// Since is the time the subscription entered its state, retries while
+	// backing off keep the time of the first failure
+	Since           time.Time `json:"since"`
+	LastError       string    `json:"last_error,omitempty"`
+	LastErrorTime   time.Time `json:"last_error_time,omitempty"`
+	LastMessageTime time.Time `json:"last_message_time,omitempty"`
+}
+
+// SubscriptionHealth keeps track of the status of every subscription consumer
+type SubscriptionHealth struct {
+	mu   sync.RWMutex
+	subs map[string]*SubscriptionStatus
+}
+
+// DefaultSubscriptionHealth is the registry used by Subscribe
+var DefaultSubscriptionHealth = NewSubscriptionHealth()
+
+// NewSubscriptionHealth returns an empty subscription health registry
+func NewSubscriptionHealth() *SubscriptionHealth {
+	return &SubscriptionHealth{
+		subs: make(map[string]*SubscriptionStatus),
+	}
+}
+
+// Running marks the subscription as running
+func (h *SubscriptionHealth) Running(name string) {
+	h.setState(name, SubscriptionRunning, nil)
+}
+
+// CatchingUp marks the subscription as replaying past events
+func (h *SubscriptionHealth) CatchingUp(name string) {
+	h.setState(name, SubscriptionCatchingUp, nil)
+}
+
+// BackingOff marks the subscription as waiting to retry after err
+func (h *SubscriptionHealth) BackingOff(name string, err error) {
+	h.setState(name, SubscriptionBackingOff, err)
+}
+
+// Stopped marks the subscription as no longer consuming messages
+func (h *SubscriptionHealth) Stopped(name string, err error) {
+	h.setState(name, SubscriptionStopped, err)
+}
+
+// Received records that a message has just been received by the subscription
+func (h *SubscriptionHealth) Received(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status(name).LastMessageTime = time.Now()
+}
+
+// Statuses returns a copy of every subscription status sorted by name
+func (h *SubscriptionHealth) Statuses() []SubscriptionStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	out := make([]SubscriptionStatus, 0, len(h.subs))
+	for _, st := range h.subs {
+		out = append(out, *st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Serving reports if every subscription is consuming messages. A subscription
+// stopped, or backing off for longer than maxBackoff, is not serving
+func (h *SubscriptionHealth) Serving(maxBackoff time.Duration) bool {
+	for _, st := range h.Statuses() {
+		switch st.State {
+		case SubscriptionStopped:
+			return false
+		case SubscriptionBackingOff:
+			if time.Since(st.Since) > maxBackoff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (h *SubscriptionHealth) setState(name string, state SubscriptionState, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := h.status(name)
+	if st.State != state {
+		st.State = state
+		st.Since = time.Now()
+	}
+	if err != nil {
+		st.LastError = err.Error()
+		st.LastErrorTime = time.Now()
+	}
+}
+
+// status returns the status by name, must be called with the lock held
+func (h *SubscriptionHealth) status(name string) *SubscriptionStatus {
+	st, ok := h.subs[name]
+	if !ok {
+		st = &SubscriptionStatus{Name: name, Since: time.Now()}
+		h.subs[name] = st
+	}
+	return st
+}
+
+// -----------------------------------------------------------------------------
+
+// SubscriptionsHealthMiddleware answers the pluto /_health check of the server
+// it is attached to with the subscriptions health, so the server is reported
+// as not serving by the pluto health server when consumers are dead
+func SubscriptionsHealthMiddleware(h *SubscriptionHealth, maxBackoff time.Duration) router.Middleware {
+	return func(next router.HandlerFunc) router.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/_health" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !h.Serving(maxBackoff) {
+				reply.Json(w, r, http.StatusTooManyRequests,
+					&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING})
+				return
+			}
+			reply.Json(w, r, http.StatusOK,
+				&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING})
+		}
+	}
+}
+
+// subscriptionsHandler lists the status of every subscription
+func subscriptionsHandler(h *SubscriptionHealth) router.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reply.Json(w, r, http.StatusOK, h.Statuses())
+	}
+}
+
+// NewSubscriptionsServer returns a pluto http server reporting the health of
+// the subscriptions started by Subscribe. Once added to the service its
+// health is available at /_health/server/subscriptions on the pluto health
+// server and statuses are listed at /_subscriptions
+func NewSubscriptionsServer(addr string) *server.Server {
+	mux := router.New()
+	mux.GET("/_subscriptions", subscriptionsHandler(DefaultSubscriptionHealth))
+	return server.New(
+		server.Name(SubscriptionsServerName),
+		server.Addr(addr),
+		server.Mux(mux),
+		server.Middlewares(SubscriptionsHealthMiddleware(DefaultSubscriptionHealth, DefaultMaxBackoff)),
+	)
+}
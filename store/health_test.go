@@ -0,0 +1,100 @@
+package store_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aukbit/pluto-event-source/pubsubtest"
+	"github.com/aukbit/pluto-event-source/store"
+)
+
+func subscriptionStatus(h *store.SubscriptionHealth, name string) (store.SubscriptionStatus, bool) {
+	for _, st := range h.Statuses() {
+		if st.Name == name {
+			return st, true
+		}
+	}
+	return store.SubscriptionStatus{}, false
+}
+
+func TestSubscriptionHealth(t *testing.T) {
+	h := store.NewSubscriptionHealth()
+	h.Running("orders")
+	if !h.Serving(time.Minute) {
+		t.Fatal("expected running subscription to be serving")
+	}
+	h.BackingOff("orders", errors.New("unavailable"))
+	first, _ := subscriptionStatus(h, "orders")
+	time.Sleep(20 * time.Millisecond)
+	h.BackingOff("orders", errors.New("unavailable"))
+	st, _ := subscriptionStatus(h, "orders")
+	if !st.Since.Equal(first.Since) {
+		t.Fatalf("expected backing off since %v got %v", first.Since, st.Since)
+	}
+	if !st.LastErrorTime.After(first.LastErrorTime) {
+		t.Fatal("expected last error time to be updated")
+	}
+	if h.Serving(10 * time.Millisecond) {
+		t.Fatal("expected subscription backing off longer than max backoff not to be serving")
+	}
+	if !h.Serving(time.Minute) {
+		t.Fatal("expected subscription backing off shorter than max backoff to be serving")
+	}
+	h.Running("orders")
+	if !h.Serving(10 * time.Millisecond) {
+		t.Fatal("expected recovered subscription to be serving")
+	}
+	h.Stopped("orders", errors.New("not found"))
+	if h.Serving(time.Minute) {
+		t.Fatal("expected stopped subscription not to be serving")
+	}
+}
+
+func TestSubscriptionHealthReceiveFailing(t *testing.T) {
+	prev := store.DefaultSubscriptionHealth
+	store.DefaultSubscriptionHealth = store.NewSubscriptionHealth()
+	defer func() { store.DefaultSubscriptionHealth = prev }()
+	h := store.DefaultSubscriptionHealth
+
+	ps := pubsubtest.New(t)
+	defer ps.Close()
+	ps.Subscribe("billing", store.Topics{"order_created": {pubsubtest.Record(nil).Action}},
+		store.ReceiveRetryDelay(10*time.Millisecond))
+	name := store.SubscriptionName(os.Getenv("GCP_PROJECT_ENV"), "billing", "order_created")
+	waitFor(t, func() bool {
+		st, _ := subscriptionStatus(h, name)
+		return st.State == store.SubscriptionRunning
+	})
+	// every Receive fails once the subscription is deleted
+	if err := ps.Client().Subscription(name).Delete(ps.Context()); err != nil {
+		t.Fatal(err)
+	}
+	var first store.SubscriptionStatus
+	waitFor(t, func() bool {
+		first, _ = subscriptionStatus(h, name)
+		return first.State == store.SubscriptionBackingOff
+	})
+	waitFor(t, func() bool {
+		st, _ := subscriptionStatus(h, name)
+		return st.LastErrorTime.After(first.LastErrorTime)
+	})
+	st, _ := subscriptionStatus(h, name)
+	if st.State != store.SubscriptionBackingOff || !st.Since.Equal(first.Since) {
+		t.Fatalf("expected backing off since %v got %s since %v", first.Since, st.State, st.Since)
+	}
+	waitFor(t, func() bool { return !h.Serving(50 * time.Millisecond) })
+}
+
+// waitFor waits until cond is true, failing the test after a few seconds
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+)
+
+const (
+	// IdempotencyKeyMetadataKey constant to be used as the key in Event Metadata,
+	// Aggregate metadata or grpc metadata holding the command idempotency key
+	IdempotencyKeyMetadataKey string = "idempotency_key"
+
+	// DefaultIdempotencyWindow is the number of most recent aggregate versions
+	// searched for an idempotency key
+	DefaultIdempotencyWindow int64 = 100
+)
+
+// WithIdempotencyKey returns a copy of parent ctx in which commands run by
+// Aggregate carry the idempotency key. Clients may send it in the grpc
+// metadata instead, under IdempotencyKeyMetadataKey
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return WithContextAny(ctx, IdempotencyKeyMetadataKey, key)
+}
+
+// idempotencyKey returns the key from the aggregate metadata or the context
+func idempotencyKey(ctx context.Context, metadata map[string]string) string {
+	if key := metadata[IdempotencyKeyMetadataKey]; key != "" {
+		return key
+	}
+	key, _ := FromContextAny(ctx, IdempotencyKeyMetadataKey).(string)
+	return key
+}
+
+// eventIdempotencyKey returns the key the event was created with, if any
+func eventIdempotencyKey(e *pb.Event) string {
+	if key := e.GetMetadata()[IdempotencyKeyMetadataKey]; key != "" {
+		return key
+	}
+	return e.GetAggregate().GetMetadata()[IdempotencyKeyMetadataKey]
+}
+
+// recordIdempotencyKey keeps the version of the event created with a key
+func (s *Store) recordIdempotencyKey(e *pb.Event) {
+	key := eventIdempotencyKey(e)
+	if key == "" {
+		return
+	}
+	if s.keys == nil {
+		s.keys = make(map[string]int64)
+	}
+	s.keys[key] = e.Aggregate.GetVersion()
+}
+
+// findIdempotencyKey reports if an event created with the key is within the
+// last DefaultIdempotencyWindow versions of the aggregate. Versions skipped by
+// starting from a cached state are read from the event store
+func (s *Store) findIdempotencyKey(ctx context.Context, id, key string) (bool, error) {
+	lowest := s.Version - DefaultIdempotencyWindow + 1
+	if lowest < 1 {
+		lowest = 1
+	}
+	if v, ok := s.keys[key]; ok && v >= lowest {
+		return true, nil
+	}
+	if s.LowestVersion <= lowest {
+		return false, nil
+	}
+	it, err := newEventIterator(ctx, EventQuery{
+		AggregateID:    id,
+		LowestVersion:  lowest,
+		HighestVersion: s.LowestVersion - 1,
+	}, false)
+	if err != nil {
+		return false, err
+	}
+	defer it.Close()
+	for it.Next() {
+		if eventIdempotencyKey(it.Event()) == key {
+			return true, nil
+		}
+	}
+	return false, it.Err()
+}
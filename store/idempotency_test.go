@@ -0,0 +1,96 @@
+package store_test
+
+import (
+	"testing"
+
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/aukbit/pluto-event-source/storetest"
+)
+
+func TestAggregateIdempotencyKey(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	c := &counter{}
+	ctx := store.WithIdempotencyKey(h.Context(), "k1")
+	if _, err := store.Aggregate(ctx, &pb.Aggregate{}, "1", &pb.Aggregate{}, "counted", nil, c.apply); err != nil {
+		t.Fatal(err)
+	}
+	// the current state is returned
+	s, err := store.Aggregate(ctx, &pb.Aggregate{}, "1", &pb.Aggregate{}, "counted", nil, c.apply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Version != 1 {
+		t.Fatalf("expected state at version 1 got %d", s.Version)
+	}
+	if n := len(h.Events("1")); n != 1 {
+		t.Fatalf("expected command with the same key to be appended once got %d events", n)
+	}
+	// the key in the aggregate metadata
+	md := map[string]string{store.IdempotencyKeyMetadataKey: "k2"}
+	for i := 0; i < 2; i++ {
+		if _, err := store.Aggregate(h.Context(), &pb.Aggregate{}, "1", &pb.Aggregate{}, "counted", md, c.apply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(h.Events("1")); n != 2 {
+		t.Fatalf("expected 2 events got %d", n)
+	}
+	// other keys, or none, are appended
+	for _, ctx := range []context.Context{store.WithIdempotencyKey(h.Context(), "k3"), h.Context(), h.Context()} {
+		if _, err := store.Aggregate(ctx, &pb.Aggregate{}, "1", &pb.Aggregate{}, "counted", nil, c.apply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(h.Events("1")); n != 5 {
+		t.Fatalf("expected 5 events got %d", n)
+	}
+}
+
+func TestAggregateIdempotencyKeyBeforeSnapshot(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	c := &counter{}
+	ctx := store.WithIdempotencyKey(h.Context(), "k1")
+	if _, err := store.Aggregate(ctx, &pb.Aggregate{}, "1", &pb.Aggregate{}, "counted", nil, c.apply); err != nil {
+		t.Fatal(err)
+	}
+	// the event with the key is before the snapshot and the cached state
+	snapshotAt(t, h, "1", 2, c)
+	cache, err := store.NewStateCache(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = store.WithStateCache(ctx, cache)
+	for i := 0; i < 2; i++ {
+		if _, err := store.Aggregate(ctx, &pb.Aggregate{}, "1", &pb.Aggregate{}, "counted", nil, c.apply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(h.Events("1")); n != 3 {
+		t.Fatalf("expected command with the same key not to be appended got %d events", n)
+	}
+}
+
+func TestAggregateIdempotencyWindow(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	c := &counter{}
+	ctx := store.WithIdempotencyKey(h.Context(), "k1")
+	if _, err := store.Aggregate(ctx, &pb.Aggregate{}, "1", &pb.Aggregate{}, "counted", nil, c.apply); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < store.DefaultIdempotencyWindow; i++ {
+		h.Append("1", storetest.Event("counted", &pb.Aggregate{}))
+	}
+	// the key is older than the window
+	if _, err := store.Aggregate(ctx, &pb.Aggregate{}, "1", &pb.Aggregate{}, "counted", nil, c.apply); err != nil {
+		t.Fatal(err)
+	}
+	if n := int64(len(h.Events("1"))); n != store.DefaultIdempotencyWindow+2 {
+		t.Fatalf("expected command with a key out of the window to be appended got %d events", n)
+	}
+}
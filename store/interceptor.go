@@ -0,0 +1,70 @@
+package store
+
+import (
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/aukbit/pluto/common"
+	plutoSrv "github.com/aukbit/pluto/server"
+)
+
+// eventID returns the event id from the context, or a new one
+func eventID(ctx context.Context) string {
+	if eid, ok := FromContextAny(ctx, "eid").(string); ok && eid != "" {
+		return eid
+	}
+	return common.RandID("", 16)
+}
+
+// EventIDUnaryServerInterceptor sets the event id received in the grpc metadata,
+// or a new one, in the context, logger and outgoing metadata of every unary
+// handler of a pluto grpc server, and in the response header
+func EventIDUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		eid := eventID(ctx)
+		if err := grpc.SetHeader(ctx, metadata.Pairs("eid", eid)); err != nil {
+			return nil, err
+		}
+		return handler(updateContext(ctx, eid), req)
+	}
+}
+
+// EventIDStreamServerInterceptor is the stream version of
+// EventIDUnaryServerInterceptor
+func EventIDStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		eid := eventID(ss.Context())
+		if err := ss.SetHeader(metadata.Pairs("eid", eid)); err != nil {
+			return err
+		}
+		ws := plutoSrv.WrapServerStreamWithContext(ss)
+		ws.SetContext(updateContext(ss.Context(), eid))
+		return handler(srv, ws)
+	}
+}
+
+// EventIDUnaryClientInterceptor sends the event id from the context, or a new
+// one, in the grpc metadata of every call
+func EventIDUnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(outgoingEventID(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+// EventIDStreamClientInterceptor is the stream version of
+// EventIDUnaryClientInterceptor
+func EventIDStreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(outgoingEventID(ctx), desc, cc, method, opts...)
+	}
+}
+
+// outgoingEventID adds the event id to the outgoing metadata, unless it is
+// already there
+func outgoingEventID(ctx context.Context) context.Context {
+	if md, ok := metadata.FromOutgoingContext(ctx); ok && len(md["eid"]) > 0 {
+		return ctx
+	}
+	return toOutgoingContext(ctx, "eid", eventID(ctx))
+}
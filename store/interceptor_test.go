@@ -0,0 +1,143 @@
+package store_test
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto-event-source/store"
+)
+
+// handlerIDs event ids seen by a grpc handler behind the server interceptors
+type handlerIDs struct {
+	context, outgoing string
+}
+
+// eidService records the event ids seen by its handlers
+type eidService struct {
+	seen chan handlerIDs
+}
+
+func (s *eidService) record(ctx context.Context) {
+	var ids handlerIDs
+	ids.context, _ = store.FromContextAny(ctx, "eid").(string)
+	if md, ok := metadata.FromOutgoingContext(ctx); ok && len(md["eid"]) == 1 {
+		ids.outgoing = md["eid"][0]
+	}
+	s.seen <- ids
+}
+
+func (s *eidService) Create(ctx context.Context, e *pb.Event) (*pb.Ack, error) {
+	s.record(ctx)
+	return &pb.Ack{Ok: true}, nil
+}
+
+func (s *eidService) Snap(ctx context.Context, e *pb.Event) (*pb.Ack, error) {
+	return &pb.Ack{Ok: true}, nil
+}
+
+func (s *eidService) Get(ctx context.Context, e *pb.Event) (*pb.Event, error) {
+	return e, nil
+}
+
+func (s *eidService) List(q *pb.Query, stream pb.EventSourceProjection_ListServer) error {
+	s.record(stream.Context())
+	return stream.Send(&pb.Event{})
+}
+
+// eidServer runs an in-process grpc server with the event id server
+// interceptors and returns its address and the ids seen by its handlers
+func eidServer(t *testing.T) (string, <-chan handlerIDs, func()) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := &eidService{seen: make(chan handlerIDs, 1)}
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(store.EventIDUnaryServerInterceptor()),
+		grpc.StreamInterceptor(store.EventIDStreamServerInterceptor()),
+	)
+	pb.RegisterEventSourceCommandServer(srv, svc)
+	pb.RegisterEventSourceProjectionServer(srv, svc)
+	go srv.Serve(lis)
+	return lis.Addr().String(), svc.seen, srv.Stop
+}
+
+// callEventID calls the server unary or stream method and returns the event id
+// of the response header
+func callEventID(t *testing.T, conn *grpc.ClientConn, ctx context.Context, stream bool) string {
+	t.Helper()
+	var header metadata.MD
+	if stream {
+		s, err := pb.NewEventSourceProjectionClient(conn).List(ctx, &pb.Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			if _, err := s.Recv(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if header, err = s.Header(); err != nil {
+			t.Fatal(err)
+		}
+	} else if _, err := pb.NewEventSourceCommandClient(conn).Create(ctx, &pb.Event{}, grpc.Header(&header)); err != nil {
+		t.Fatal(err)
+	}
+	if len(header["eid"]) != 1 {
+		t.Fatalf("expected an event id in the response header got %v", header["eid"])
+	}
+	return header["eid"][0]
+}
+
+func TestEventIDInterceptors(t *testing.T) {
+	addr, seen, stop := eidServer(t)
+	defer stop()
+	plain, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	intercepted, err := grpc.Dial(addr, grpc.WithInsecure(),
+		grpc.WithUnaryInterceptor(store.EventIDUnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(store.EventIDStreamClientInterceptor()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer intercepted.Close()
+
+	bg := context.Background()
+	for _, tc := range []struct {
+		name string
+		conn *grpc.ClientConn
+		ctx  context.Context
+		// want event id propagated, any new one if empty
+		want string
+	}{
+		{"generated by the server", plain, bg, ""},
+		{"received in the metadata", plain, metadata.NewOutgoingContext(bg, metadata.Pairs("eid", "md")), "md"},
+		{"generated by the client", intercepted, bg, ""},
+		{"sent from the context", intercepted, store.WithContextAny(bg, "eid", "ctx"), "ctx"},
+		{"already in the outgoing metadata", intercepted, metadata.NewOutgoingContext(store.WithContextAny(bg, "eid", "ctx"), metadata.Pairs("eid", "md")), "md"},
+	} {
+		for _, stream := range []bool{false, true} {
+			header := callEventID(t, tc.conn, tc.ctx, stream)
+			ids := <-seen
+			if tc.want != "" && ids.context != tc.want {
+				t.Fatalf("%s, stream %v: expected event id %q got %q", tc.name, stream, tc.want, ids.context)
+			}
+			if ids.context == "" || ids.outgoing != ids.context || header != ids.context {
+				t.Fatalf("%s, stream %v: expected the same event id in the handler context %q, its outgoing metadata %q and the response header %q", tc.name, stream, ids.context, ids.outgoing, header)
+			}
+		}
+	}
+}
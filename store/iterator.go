@@ -0,0 +1,214 @@
+package store
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto"
+	"github.com/aukbit/pluto/client"
+	"github.com/pkg/errors"
+)
+
+// EventQuery defines which events are listed from the event store
+type EventQuery struct {
+	// AggregateID lists the events of a single aggregate
+	AggregateID string
+	// LowestVersion and HighestVersion bound the aggregate versions listed,
+	// 0 meaning no bound
+	LowestVersion  int64
+	HighestVersion int64
+	// Schema lists events of an aggregate schema, e.g. *orders.Order
+	Schema string
+	// CreatedFrom and CreatedTo list events created within the time range,
+	// zero meaning no bound
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	// AfterSequence lists events appended after a global sequence number
+	AfterSequence int64
+	// Limit maximum number of events listed, 0 meaning no limit
+	Limit int
+	// Topics filters the events listed by topic, empty meaning all topics
+	Topics []string
+	// Raw lists the events as stored, their data not decrypted nor
+	// decompressed, e.g. to inspect events failing to decode
+	Raw bool
+}
+
+// params returns the query params understood by the projection service
+func (q EventQuery) params() map[string]string {
+	params := make(map[string]string)
+	if q.AggregateID != "" {
+		params[AggregatorIDQueryKey] = q.AggregateID
+	}
+	if q.HighestVersion != 0 {
+		params[HighestVersionQueryKey] = strconv.FormatInt(q.HighestVersion, 10)
+	}
+	if q.LowestVersion != 0 {
+		params[LowestVersionQueryKey] = strconv.FormatInt(q.LowestVersion, 10)
+	}
+	if len(q.Topics) > 0 {
+		params[TopicQueryKey] = strings.Join(q.Topics, ",")
+	}
+	if q.Schema != "" {
+		params[SchemaQueryKey] = q.Schema
+	}
+	if !q.CreatedFrom.IsZero() {
+		params[CreatedFromQueryKey] = q.CreatedFrom.UTC().Format(time.RFC3339Nano)
+	}
+	if !q.CreatedTo.IsZero() {
+		params[CreatedToQueryKey] = q.CreatedTo.UTC().Format(time.RFC3339Nano)
+	}
+	if q.AfterSequence != 0 {
+		params[SequenceQueryKey] = strconv.FormatInt(q.AfterSequence, 10)
+	}
+	if q.Limit != 0 {
+		params[LimitQueryKey] = strconv.Itoa(q.Limit)
+	}
+	return params
+}
+
+// EventIterator iterates over the events streamed by the projection service,
+// with their aggregate data decrypted and decompressed as UnmarshalEventData
+// does unless the query is Raw. It must be closed to release the underlying
+// connection
+//
+//	it, err := NewEventIterator(ctx, EventQuery{AggregateID: id})
+//	if err != nil {
+//		return err
+//	}
+//	defer it.Close()
+//	for it.Next() {
+//		e := it.Event()
+//		...
+//	}
+//	return it.Err()
+type EventIterator struct {
+	ctx    context.Context
+	conn   *grpc.ClientConn
+	cancel context.CancelFunc
+	stream pb.EventSourceProjection_ListClient
+	topics map[string]bool
+	schema string
+	// decode is false for events only read for their version or metadata
+	decode bool
+	event  *pb.Event
+	err    error
+	closed bool
+	// received counts every event streamed, filtered or not, and
+	// lastSequence holds the global sequence of the last one
+	received     int
+	lastSequence int64
+}
+
+// NewEventIterator lists the events matching the query
+func NewEventIterator(ctx context.Context, q EventQuery) (*EventIterator, error) {
+	return newEventIterator(ctx, q, !q.Raw)
+}
+
+// newEventIterator lists the events matching the query, decoding their data
+// if decode is true
+func newEventIterator(ctx context.Context, q EventQuery, decode bool) (*EventIterator, error) {
+	c, ok := pluto.FromContext(ctx).Client(EventSourceQueryClientName)
+	if !ok {
+		return nil, errors.Wrap(errEventSourceClientNotAvailable, EventSourceQueryClientName)
+	}
+	conn, err := c.Dial(client.Timeout(2 * time.Second))
+	if err != nil {
+		return nil, err
+	}
+	// cancel the stream if the iterator is closed before being exhausted
+	cctx, cancel := context.WithCancel(ctx)
+	stream, err := c.Stub(conn).(pb.EventSourceProjectionClient).List(cctx, &pb.Query{Params: q.params()})
+	if err != nil {
+		cancel()
+		conn.Close()
+		return nil, err
+	}
+	it := &EventIterator{
+		ctx:    ctx,
+		conn:   conn,
+		cancel: cancel,
+		stream: stream,
+		schema: q.Schema,
+		decode: decode,
+	}
+	if len(q.Topics) > 0 {
+		it.topics = make(map[string]bool)
+		for _, t := range q.Topics {
+			it.topics[t] = true
+		}
+	}
+	return it, nil
+}
+
+// Next advances the iterator to the next event. It returns false when there
+// are no more events, an error occurred or the iterator is closed
+func (it *EventIterator) Next() bool {
+	if it.err != nil || it.closed {
+		it.event = nil
+		return false
+	}
+	for {
+		e, err := it.stream.Recv()
+		if err == io.EOF {
+			it.event = nil
+			return false
+		}
+		if err != nil {
+			it.event, it.err = nil, err
+			return false
+		}
+		it.received++
+		if seq, ok := eventSequence(e); ok {
+			it.lastSequence = seq
+		}
+		// filter on the client side too, in case the projection service
+		// does not support the query params
+		if it.topics != nil && !it.topics[e.GetTopic()] {
+			continue
+		}
+		if it.schema != "" && it.schema != e.GetAggregate().GetSchema() {
+			continue
+		}
+		if it.decode {
+			if e, err = decodeEvent(it.ctx, e); err != nil {
+				it.event, it.err = nil, err
+				return false
+			}
+		}
+		it.event = e
+		return true
+	}
+}
+
+// Event returns the current event
+func (it *EventIterator) Event() *pb.Event {
+	return it.event
+}
+
+// Err returns the error, if any, that stopped the iteration
+func (it *EventIterator) Err() error {
+	return it.err
+}
+
+// Close stops the stream and closes the connection
+func (it *EventIterator) Close() error {
+	it.closed = true
+	it.cancel()
+	return it.conn.Close()
+}
+
+// eventSequence returns the global sequence assigned by the event store
+func eventSequence(e *pb.Event) (int64, bool) {
+	seq, err := strconv.ParseInt(e.GetMetadata()[SequenceMetadataKey], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
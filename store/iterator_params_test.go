@@ -0,0 +1,39 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEventQueryParams(t *testing.T) {
+	at := time.Date(2018, 1, 2, 3, 4, 5, 6, time.FixedZone("", 3600))
+	got := EventQuery{
+		AggregateID:    "1",
+		LowestVersion:  2,
+		HighestVersion: 3,
+		Schema:         "*es.Aggregate",
+		CreatedFrom:    at,
+		CreatedTo:      at.Add(time.Hour),
+		AfterSequence:  4,
+		Limit:          5,
+		Topics:         []string{"created", "paid"},
+	}.params()
+	want := map[string]string{
+		AggregatorIDQueryKey:   "1",
+		LowestVersionQueryKey:  "2",
+		HighestVersionQueryKey: "3",
+		SchemaQueryKey:         "*es.Aggregate",
+		CreatedFromQueryKey:    "2018-01-02T02:04:05.000000006Z",
+		CreatedToQueryKey:      "2018-01-02T03:04:05.000000006Z",
+		SequenceQueryKey:       "4",
+		LimitQueryKey:          "5",
+		TopicQueryKey:          "created,paid",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected params %v got %v", want, got)
+	}
+	if got := (EventQuery{}).params(); len(got) != 0 {
+		t.Fatalf("expected no params for an empty query got %v", got)
+	}
+}
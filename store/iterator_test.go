@@ -0,0 +1,80 @@
+package store_test
+
+import (
+	"fmt"
+	"testing"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/aukbit/pluto-event-source/storetest"
+)
+
+// iterate returns the aggregate id, version and topic of the events listed
+func iterate(t *testing.T, h *storetest.Harness, q store.EventQuery) []string {
+	t.Helper()
+	it, err := store.NewEventIterator(h.Context(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	var out []string
+	for it.Next() {
+		e := it.Event()
+		out = append(out, fmt.Sprintf("%s/%d/%s", e.Aggregate.GetId(), e.Aggregate.GetVersion(), e.GetTopic()))
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestEventIterator(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	h.Append("1", storetest.Event("created", &pb.Aggregate{}), storetest.Event("paid", &pb.Aggregate{}))
+	h.Append("2", storetest.Event("created", &pb.Event{}))
+	h.Append("1", storetest.Event("shipped", &pb.Aggregate{}))
+	for _, tc := range []struct {
+		q    store.EventQuery
+		want string
+	}{
+		{store.EventQuery{AggregateID: "1"}, "[1/1/created 1/2/paid 1/3/shipped]"},
+		{store.EventQuery{AggregateID: "1", LowestVersion: 2}, "[1/2/paid 1/3/shipped]"},
+		{store.EventQuery{AggregateID: "1", HighestVersion: 2}, "[1/1/created 1/2/paid]"},
+		{store.EventQuery{AggregateID: "1", Limit: 1}, "[1/1/created]"},
+		{store.EventQuery{Topics: []string{"created"}}, "[1/1/created 2/1/created]"},
+		{store.EventQuery{Topics: []string{"paid", "shipped"}}, "[1/2/paid 1/3/shipped]"},
+		{store.EventQuery{Schema: "*es.Event"}, "[2/1/created]"},
+		{store.EventQuery{Schema: "*es.Aggregate", Topics: []string{"created"}}, "[1/1/created]"},
+		{store.EventQuery{AfterSequence: 2}, "[2/1/created 1/3/shipped]"},
+	} {
+		if got := fmt.Sprint(iterate(t, h, tc.q)); got != tc.want {
+			t.Fatalf("%+v: expected %s got %s", tc.q, tc.want, got)
+		}
+	}
+}
+
+func TestEventIteratorClose(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	for i := 0; i < 5; i++ {
+		h.Append("1", storetest.Event("counted", &pb.Aggregate{}))
+	}
+	it, err := store.NewEventIterator(h.Context(), store.EventQuery{AggregateID: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !it.Next() || it.Event().Aggregate.GetVersion() != 1 {
+		t.Fatalf("expected first event got %v, %v", it.Event(), it.Err())
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if it.Next() {
+		t.Fatal("expected no event after close")
+	}
+	// the event store serves new iterators once the stream closed is cancelled
+	if got := iterate(t, h, store.EventQuery{AggregateID: "1", LowestVersion: 5}); fmt.Sprint(got) != "[1/5/counted]" {
+		t.Fatalf("expected last event listed got %v", got)
+	}
+}
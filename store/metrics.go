@@ -0,0 +1,176 @@
+package store
+
+import (
+	"time"
+
+	context "golang.org/x/net/context"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// Tag keys used by the event source measures
+var (
+	KeySchema       = mustNewKey("es_schema")
+	KeyTopic        = mustNewKey("es_topic")
+	KeySubscription = mustNewKey("es_subscription")
+)
+
+// Measures recorded by the store
+var (
+	MEventsReplayed         = stats.Int64("pluto_event_source/events_replayed", "Number of events replayed by LoadEvents", stats.UnitDimensionless)
+	MLoadLatency            = stats.Float64("pluto_event_source/load_latency", "Time spent loading events", stats.UnitMilliseconds)
+	MDispatchLatency        = stats.Float64("pluto_event_source/dispatch_latency", "Time spent dispatching an event", stats.UnitMilliseconds)
+	MSnapshotLatency        = stats.Float64("pluto_event_source/snapshot_latency", "Time spent creating a snapshot", stats.UnitMilliseconds)
+	MConcurrencyConflicts   = stats.Int64("pluto_event_source/concurrency_conflicts", "Number of concurrency exceptions returned by the event store on Dispatch", stats.UnitDimensionless)
+	MAggregateRetries       = stats.Int64("pluto_event_source/aggregate_retries", "Number of times Aggregate retried a command after a concurrency exception", stats.UnitDimensionless)
+	MVersionInconsistencies = stats.Int64("pluto_event_source/version_inconsistencies", "Number of missing, duplicated or out of order versions found while replaying", stats.UnitDimensionless)
+	MMessagesReceived       = stats.Int64("pluto_event_source/messages_received", "Number of messages received on a subscription", stats.UnitDimensionless)
+	MMessagesAcked          = stats.Int64("pluto_event_source/messages_acked", "Number of messages acked on a subscription", stats.UnitDimensionless)
+	MMessagesNacked         = stats.Int64("pluto_event_source/messages_nacked", "Number of messages nacked on a subscription", stats.UnitDimensionless)
+	MActionLatency          = stats.Float64("pluto_event_source/action_latency", "Time spent running an action", stats.UnitMilliseconds)
+	MHookLatency            = stats.Float64("pluto_event_source/hook_latency", "Time spent running a hook function", stats.UnitMilliseconds)
+)
+
+var (
+	defaultLatencyDistribution = view.Distribution(0, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000)
+	defaultCountDistribution   = view.Distribution(0, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 5000)
+)
+
+// Views available for the store measures
+var (
+	EventsReplayedView = &view.View{
+		Name:        "pluto_event_source/events_replayed",
+		Description: "Distribution of events replayed per LoadEvents",
+		Measure:     MEventsReplayed,
+		TagKeys:     []tag.Key{KeySchema},
+		Aggregation: defaultCountDistribution,
+	}
+	LoadLatencyView = &view.View{
+		Name:        "pluto_event_source/load_latency",
+		Description: "Distribution of LoadEvents latency",
+		Measure:     MLoadLatency,
+		TagKeys:     []tag.Key{KeySchema},
+		Aggregation: defaultLatencyDistribution,
+	}
+	DispatchLatencyView = &view.View{
+		Name:        "pluto_event_source/dispatch_latency",
+		Description: "Distribution of Dispatch latency",
+		Measure:     MDispatchLatency,
+		TagKeys:     []tag.Key{KeySchema, KeyTopic},
+		Aggregation: defaultLatencyDistribution,
+	}
+	SnapshotLatencyView = &view.View{
+		Name:        "pluto_event_source/snapshot_latency",
+		Description: "Distribution of Snapit latency",
+		Measure:     MSnapshotLatency,
+		TagKeys:     []tag.Key{KeySchema},
+		Aggregation: defaultLatencyDistribution,
+	}
+	ConcurrencyConflictsView = &view.View{
+		Name:        "pluto_event_source/concurrency_conflicts",
+		Description: "Count of concurrency exceptions",
+		Measure:     MConcurrencyConflicts,
+		TagKeys:     []tag.Key{KeySchema, KeyTopic},
+		Aggregation: view.Count(),
+	}
+	AggregateRetriesView = &view.View{
+		Name:        "pluto_event_source/aggregate_retries",
+		Description: "Count of Aggregate retries",
+		Measure:     MAggregateRetries,
+		TagKeys:     []tag.Key{KeySchema, KeyTopic},
+		Aggregation: view.Count(),
+	}
+	VersionInconsistenciesView = &view.View{
+		Name:        "pluto_event_source/version_inconsistencies",
+		Description: "Count of version inconsistencies found while replaying",
+		Measure:     MVersionInconsistencies,
+		TagKeys:     []tag.Key{KeySchema},
+		Aggregation: view.Count(),
+	}
+	MessagesReceivedView = &view.View{
+		Name:        "pluto_event_source/messages_received",
+		Description: "Count of messages received per subscription",
+		Measure:     MMessagesReceived,
+		TagKeys:     []tag.Key{KeySubscription},
+		Aggregation: view.Count(),
+	}
+	MessagesAckedView = &view.View{
+		Name:        "pluto_event_source/messages_acked",
+		Description: "Count of messages acked per subscription",
+		Measure:     MMessagesAcked,
+		TagKeys:     []tag.Key{KeySubscription, KeyTopic},
+		Aggregation: view.Count(),
+	}
+	MessagesNackedView = &view.View{
+		Name:        "pluto_event_source/messages_nacked",
+		Description: "Count of messages nacked per subscription",
+		Measure:     MMessagesNacked,
+		TagKeys:     []tag.Key{KeySubscription, KeyTopic},
+		Aggregation: view.Count(),
+	}
+	ActionLatencyView = &view.View{
+		Name:        "pluto_event_source/action_latency",
+		Description: "Distribution of action latency per topic",
+		Measure:     MActionLatency,
+		TagKeys:     []tag.Key{KeySchema, KeyTopic},
+		Aggregation: defaultLatencyDistribution,
+	}
+	HookLatencyView = &view.View{
+		Name:        "pluto_event_source/hook_latency",
+		Description: "Distribution of hook function latency per topic",
+		Measure:     MHookLatency,
+		TagKeys:     []tag.Key{KeySchema, KeyTopic},
+		Aggregation: defaultLatencyDistribution,
+	}
+)
+
+// DefaultViews are the views provided by the store
+var DefaultViews = []*view.View{
+	EventsReplayedView,
+	LoadLatencyView,
+	DispatchLatencyView,
+	SnapshotLatencyView,
+	ConcurrencyConflictsView,
+	AggregateRetriesView,
+	VersionInconsistenciesView,
+	MessagesReceivedView,
+	MessagesAckedView,
+	MessagesNackedView,
+	ActionLatencyView,
+	HookLatencyView,
+}
+
+// RegisterViews registers all store views, exporters must be registered
+// separately with view.RegisterExporter
+func RegisterViews() error {
+	return view.Register(DefaultViews...)
+}
+
+// -----------------------------------------------------------------------------
+
+func mustNewKey(name string) tag.Key {
+	k, err := tag.NewKey(name)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// recordMeasures records measurements tagged with the non empty tag values
+func recordMeasures(ctx context.Context, tags map[tag.Key]string, ms ...stats.Measurement) {
+	var mutators []tag.Mutator
+	for k, v := range tags {
+		if v == "" {
+			continue
+		}
+		mutators = append(mutators, tag.Upsert(k, v))
+	}
+	stats.RecordWithTags(ctx, mutators, ms...)
+}
+
+// sinceInMilliseconds returns the elapsed time since t in milliseconds
+func sinceInMilliseconds(t time.Time) float64 {
+	return float64(time.Since(t).Nanoseconds()) / 1e6
+}
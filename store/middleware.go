@@ -0,0 +1,59 @@
+package store
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/aukbit/pluto/common"
+	"github.com/aukbit/pluto/server/router"
+)
+
+const (
+	// EventIDHeader header holding the event id, set by pluto http servers
+	EventIDHeader = "X-Pluto-Eid"
+
+	traceparentHeader = "Traceparent"
+)
+
+// DefaultEventIDHeaders request headers read, in order, for the event id
+var DefaultEventIDHeaders = []string{"X-Request-Id", "X-Correlation-Id"}
+
+// EventIDMiddleware sets the event id of every request of a pluto http server
+// in the request context, logger and outgoing grpc metadata, so it reaches
+// FromContextAny, Aggregate and the services called. The id is read from the
+// first header available, DefaultEventIDHeaders if none are given, then from
+// the trace id of a W3C traceparent header, then from the EventIDHeader pluto
+// sets on every request, or generated. It replaces the eid pluto set in the
+// EventIDHeader request and response headers and incoming metadata
+func EventIDMiddleware(headers ...string) router.Middleware {
+	if len(headers) == 0 {
+		headers = DefaultEventIDHeaders
+	}
+	return func(next router.HandlerFunc) router.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			eid := requestEventID(r, headers)
+			r.Header.Set(EventIDHeader, eid)
+			w.Header().Set(EventIDHeader, eid)
+			ctx := toIncomingContext(r.Context(), "eid", eid)
+			next.ServeHTTP(w, r.WithContext(updateContext(ctx, eid)))
+		}
+	}
+}
+
+// requestEventID returns the event id of the request, or a new one
+func requestEventID(r *http.Request, headers []string) string {
+	for _, h := range headers {
+		if eid := r.Header.Get(h); eid != "" {
+			return eid
+		}
+	}
+	// traceparent: version-traceid-parentid-flags
+	if parts := strings.Split(r.Header.Get(traceparentHeader), "-"); len(parts) == 4 &&
+		len(parts[1]) == 32 && parts[1] != strings.Repeat("0", 32) {
+		return parts[1]
+	}
+	if eid := r.Header.Get(EventIDHeader); eid != "" {
+		return eid
+	}
+	return common.RandID("", 16)
+}
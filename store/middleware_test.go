@@ -0,0 +1,122 @@
+package store_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/aukbit/pluto/server"
+	"github.com/aukbit/pluto/server/router"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/aukbit/pluto-event-source/store"
+)
+
+// requestIDs event ids seen by a handler behind the middleware
+type requestIDs struct {
+	context, incoming, header string
+}
+
+// eventIDServer runs a pluto http server with the middleware and returns its
+// url and the ids seen by its handler
+func eventIDServer(t *testing.T, headers ...string) (string, <-chan requestIDs, func()) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	seen := make(chan requestIDs, 1)
+	mux := router.New()
+	mux.GET("/eid", func(w http.ResponseWriter, r *http.Request) {
+		ids := requestIDs{header: r.Header.Get(store.EventIDHeader)}
+		ids.context, _ = store.FromContextAny(r.Context(), "eid").(string)
+		if md, ok := metadata.FromIncomingContext(r.Context()); ok {
+			ids.incoming = fmt.Sprint(md["eid"])
+		}
+		seen <- ids
+	})
+	s := server.New(
+		server.Addr(addr),
+		server.Mux(mux),
+		server.Middlewares(store.EventIDMiddleware(headers...)),
+		server.Logger(zerolog.New(ioutil.Discard)),
+	)
+	go s.Run()
+	url := "http://" + addr + "/eid"
+	waitFor(t, func() bool {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+		}
+		return err == nil
+	})
+	return url, seen, s.Stop
+}
+
+func TestEventIDMiddleware(t *testing.T) {
+	url, seen, stop := eventIDServer(t)
+	defer stop()
+	for name, tc := range map[string]struct {
+		header map[string]string
+		want   string
+	}{
+		"request id":  {map[string]string{"X-Request-Id": "req"}, "req"},
+		"correlation": {map[string]string{"X-Correlation-Id": "corr"}, "corr"},
+		"before eid":  {map[string]string{"X-Request-Id": "req", store.EventIDHeader: "eid"}, "req"},
+		"traceparent": {map[string]string{"Traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}, "4bf92f3577b34da6a3ce929d0e0e4736"},
+		"eid":         {map[string]string{store.EventIDHeader: "eid"}, "eid"},
+		"generated":   {nil, ""},
+	} {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		ids := <-seen
+		want := tc.want
+		if want == "" {
+			want = ids.context
+			if want == "" {
+				t.Fatalf("%s: expected eid generated", name)
+			}
+		}
+		got := requestIDs{context: ids.context, incoming: ids.incoming, header: resp.Header.Get(store.EventIDHeader)}
+		if exp := (requestIDs{want, fmt.Sprint([]string{want}), want}); got != exp || ids.header != want {
+			t.Fatalf("%s: expected eid %q in context, metadata and headers got %+v, request header %q", name, want, got, ids.header)
+		}
+		if vs := resp.Header[store.EventIDHeader]; len(vs) != 1 {
+			t.Fatalf("%s: expected one eid response header got %v", name, vs)
+		}
+	}
+}
+
+func TestEventIDMiddlewareHeaders(t *testing.T) {
+	url, seen, stop := eventIDServer(t, "X-Trace")
+	defer stop()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Request-Id", "req")
+	req.Header.Set("X-Trace", "trace")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if ids := <-seen; ids.context != "trace" || resp.Header.Get(store.EventIDHeader) != "trace" {
+		t.Fatalf("expected eid from the header configured got %+v", ids)
+	}
+}
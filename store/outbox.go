@@ -0,0 +1,318 @@
+package store
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	context "golang.org/x/net/context"
+
+	"cloud.google.com/go/pubsub"
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultRelayBatchSize  = 100
+	defaultRelayInterval   = time.Second
+	defaultRelayMaxBackoff = time.Minute
+)
+
+var (
+	errInvalidSequence = errors.New("event without a valid sequence")
+)
+
+// OutboxEntry holds an event appended to the event store and its position
+// in the outbox
+type OutboxEntry struct {
+	Sequence int64
+	Event    *pb.Event
+}
+
+// OutboxSource provides events appended to the event store in order
+type OutboxSource interface {
+	// Pending returns up to limit entries with a sequence greater than after
+	Pending(ctx context.Context, after int64, limit int) ([]OutboxEntry, error)
+}
+
+// OutboxLedger records which entries have already been relayed
+type OutboxLedger interface {
+	// Sequence returns the sequence of the last relayed entry
+	Sequence(ctx context.Context) (int64, error)
+	// Mark records that all entries up to sequence have been relayed
+	Mark(ctx context.Context, sequence int64) error
+}
+
+// Publisher delivers an event to its topic
+type Publisher interface {
+	Publish(ctx context.Context, e *pb.Event) error
+}
+
+// PublisherFunc allows the use of ordinary functions as publishers
+type PublisherFunc func(ctx context.Context, e *pb.Event) error
+
+// Publish calls f(ctx, e)
+func (f PublisherFunc) Publish(ctx context.Context, e *pb.Event) error {
+	return f(ctx, e)
+}
+
+// -----------------------------------------------------------------------------
+
+// RelayOption is used to set options for the relay
+type RelayOption func(*Relay)
+
+// RelayBatchSize sets the maximum number of entries read from source at once
+func RelayBatchSize(n int) RelayOption {
+	return func(r *Relay) {
+		r.batchSize = n
+	}
+}
+
+// RelayInterval sets how long the relay waits before polling an empty source
+func RelayInterval(d time.Duration) RelayOption {
+	return func(r *Relay) {
+		r.interval = d
+	}
+}
+
+// RelayMaxBackoff sets the maximum time the relay waits before retrying
+func RelayMaxBackoff(d time.Duration) RelayOption {
+	return func(r *Relay) {
+		r.maxBackoff = d
+	}
+}
+
+// Relay tails an outbox source and publishes every entry to its topic.
+// Entries are marked in the ledger only after being published, so delivery is
+// at-least-once: subscribers must be ready to receive the same event twice
+type Relay struct {
+	source     OutboxSource
+	ledger     OutboxLedger
+	publisher  Publisher
+	batchSize  int
+	interval   time.Duration
+	maxBackoff time.Duration
+}
+
+// NewRelay returns a new outbox relay
+func NewRelay(source OutboxSource, ledger OutboxLedger, publisher Publisher, opts ...RelayOption) *Relay {
+	r := &Relay{
+		source:     source,
+		ledger:     ledger,
+		publisher:  publisher,
+		batchSize:  defaultRelayBatchSize,
+		interval:   defaultRelayInterval,
+		maxBackoff: defaultRelayMaxBackoff,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// RelayOnce publishes the next batch of pending entries and returns the number
+// of entries relayed. It stops at the first entry failing to be published
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	after, err := r.ledger.Sequence(ctx)
+	if err != nil {
+		return 0, err
+	}
+	entries, err := r.source.Pending(ctx, after, r.batchSize)
+	if err != nil {
+		return 0, err
+	}
+	for i, en := range entries {
+		if err := r.publisher.Publish(ctx, en.Event); err != nil {
+			return i, errors.Wrapf(err, "relay sequence %d", en.Sequence)
+		}
+		if err := r.ledger.Mark(ctx, en.Sequence); err != nil {
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
+
+// Run relays entries until the context is cancelled. Failures are retried
+// with a fibonacci backoff, up to the relay max backoff
+func (r *Relay) Run(ctx context.Context) error {
+	l := zerolog.Ctx(ctx)
+	b := newBackoff(r.maxBackoff)
+	for {
+		n, err := r.RelayOnce(ctx)
+		wait := r.interval
+		switch {
+		case err != nil:
+			l.Error().Msg(err.Error())
+			wait = b.next()
+		case n > 0:
+			b.reset()
+			l.Info().Msgf("relayed %d events", n)
+			if n == r.batchSize {
+				// there may be more entries waiting
+				wait = 0
+			}
+		default:
+			b.reset()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// RelayHook starts the relay in the background after the pluto service starts
+func RelayHook(r *Relay) pluto.HookFunc {
+	return func(ctx context.Context) error {
+		go r.Run(ctx)
+		return nil
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// MemoryOutbox is an in-memory outbox source and ledger
+type MemoryOutbox struct {
+	mu       sync.Mutex
+	entries  []OutboxEntry
+	relayed  int64
+	sequence int64
+}
+
+// NewMemoryOutbox returns an empty in-memory outbox
+func NewMemoryOutbox() *MemoryOutbox {
+	return &MemoryOutbox{}
+}
+
+// Append adds events to the outbox and returns the sequence of the last one
+func (m *MemoryOutbox) Append(events ...*pb.Event) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range events {
+		m.sequence++
+		m.entries = append(m.entries, OutboxEntry{Sequence: m.sequence, Event: e})
+	}
+	return m.sequence
+}
+
+// Pending implements OutboxSource
+func (m *MemoryOutbox) Pending(ctx context.Context, after int64, limit int) ([]OutboxEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []OutboxEntry
+	for _, en := range m.entries {
+		if en.Sequence <= after {
+			continue
+		}
+		if limit > 0 && len(out) == limit {
+			break
+		}
+		out = append(out, en)
+	}
+	return out, nil
+}
+
+// Sequence implements OutboxLedger
+func (m *MemoryOutbox) Sequence(ctx context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.relayed, nil
+}
+
+// Mark implements OutboxLedger
+func (m *MemoryOutbox) Mark(ctx context.Context, sequence int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sequence > m.relayed {
+		m.relayed = sequence
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// ProjectionOutboxSource tails events from the event source query client.
+// The projection service is expected to support the SequenceQueryKey param and
+// to set SequenceMetadataKey in the metadata of every event listed.
+// Events are relayed as stored, their data still compressed and encrypted, so
+// subscribers decode them with UnmarshalEventDataContext
+type ProjectionOutboxSource struct{}
+
+// Pending implements OutboxSource
+func (ProjectionOutboxSource) Pending(ctx context.Context, after int64, limit int) ([]OutboxEntry, error) {
+	it, err := NewEventIterator(ctx, EventQuery{AfterSequence: after, Limit: limit, Raw: true})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	var out []OutboxEntry
+	for it.Next() {
+		e := it.Event()
+		seq, ok := eventSequence(e)
+		if !ok {
+			return nil, errors.Wrap(errInvalidSequence, e.GetTopic())
+		}
+		out = append(out, OutboxEntry{Sequence: seq, Event: e})
+	}
+	return out, it.Err()
+}
+
+// -----------------------------------------------------------------------------
+
+// PubsubPublisher publishes events to Cloud PubSub topics named after the
+// event topic, the same topics used by Subscribe
+type PubsubPublisher struct {
+	client *pubsub.Client
+	mu     sync.Mutex
+	topics map[string]*pubsub.Topic
+}
+
+// NewPubsubPublisher returns a new Cloud PubSub publisher
+func NewPubsubPublisher(client *pubsub.Client) *PubsubPublisher {
+	return &PubsubPublisher{
+		client: client,
+		topics: make(map[string]*pubsub.Topic),
+	}
+}
+
+// Publish implements Publisher, it blocks until the message is accepted
+func (p *PubsubPublisher) Publish(ctx context.Context, e *pb.Event) error {
+	t, err := p.topic(ctx, e.GetTopic())
+	if err != nil {
+		return err
+	}
+	data, err := proto.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = t.Publish(ctx, &pubsub.Message{Data: data}).Get(ctx)
+	return err
+}
+
+// Stop flushes and stops all topics used by the publisher
+func (p *PubsubPublisher) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, t := range p.topics {
+		t.Stop()
+	}
+}
+
+func (p *PubsubPublisher) topic(ctx context.Context, name string) (*pubsub.Topic, error) {
+	name = strings.ToLower(name)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t, ok := p.topics[name]; ok {
+		return t, nil
+	}
+	t, err := GetOrCreateTopic(ctx, p.client, name)
+	if err != nil {
+		return nil, err
+	}
+	p.topics[name] = t
+	return t, nil
+}
@@ -0,0 +1,64 @@
+package store_test
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/aukbit/pluto-event-source/storetest"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestProjectionOutboxSourceRaw(t *testing.T) {
+	prevKeys, prevCompression := store.DefaultKeyStore, store.DefaultCompression
+	store.DefaultKeyStore = store.NewMemoryKeyStore()
+	store.DefaultCompression = &store.Compression{}
+	defer func() { store.DefaultKeyStore, store.DefaultCompression = prevKeys, prevCompression }()
+
+	h := storetest.New(t)
+	defer h.Close()
+	in := &pb.Aggregate{Id: "secret", Data: bytes.Repeat([]byte("secret "), 100)}
+	e, err := store.NewEvent("counted", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := h.Context()
+	if _, err := store.AppendExpected(ctx, "1", store.ExpectNotExists, e); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var published []*pb.Event
+	p := store.PublisherFunc(func(ctx context.Context, e *pb.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		published = append(published, e)
+		return nil
+	})
+	if _, err := store.NewRelay(store.ProjectionOutboxSource{}, store.NewMemoryOutbox(), p).RelayOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 1 {
+		t.Fatalf("expected 1 event relayed got %d", len(published))
+	}
+	// relayed events keep their data encrypted and compressed
+	relayed := published[0]
+	md := relayed.Aggregate.GetMetadata()
+	if md[store.EncryptionMetadataKey] == "" || md[store.CompressionMetadataKey] == "" {
+		t.Fatalf("expected event relayed encrypted and compressed got metadata %v", md)
+	}
+	if bytes.Equal(relayed.Aggregate.Data, e.Aggregate.Data) {
+		t.Fatal("expected data relayed encrypted")
+	}
+	out := &pb.Aggregate{}
+	if err := store.UnmarshalEventDataContext(ctx, relayed, out); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(out, in) {
+		t.Fatalf("expected %v got %v", in, out)
+	}
+}
@@ -0,0 +1,155 @@
+package store
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+)
+
+func outboxEvents(ids ...string) []*pb.Event {
+	events := make([]*pb.Event, len(ids))
+	for i, id := range ids {
+		events[i] = &pb.Event{Topic: "order_created", Aggregate: &pb.Aggregate{Id: id}}
+	}
+	return events
+}
+
+// recorder is a publisher recording the ids of the events published, failing
+// the calls listed in fail by call number starting at 1
+type recorder struct {
+	mu    sync.Mutex
+	calls int
+	fail  map[int]bool
+	ids   []string
+}
+
+func (r *recorder) Publish(ctx context.Context, e *pb.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	if r.fail[r.calls] {
+		return errors.New("publish failed")
+	}
+	r.ids = append(r.ids, e.GetAggregate().GetId())
+	return nil
+}
+
+func (r *recorder) published() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.ids...)
+}
+
+func equalIDs(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRelayOnce(t *testing.T) {
+	ctx := context.Background()
+	o := NewMemoryOutbox()
+	o.Append(outboxEvents("1", "2", "3")...)
+	p := &recorder{}
+	r := NewRelay(o, o, p)
+	n, err := r.RelayOnce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 events relayed got %d", n)
+	}
+	if seq, _ := o.Sequence(ctx); seq != 3 {
+		t.Fatalf("expected ledger at sequence 3 got %d", seq)
+	}
+	// nothing left to relay
+	if n, err := r.RelayOnce(ctx); n != 0 || err != nil {
+		t.Fatalf("expected no events relayed got %d, %v", n, err)
+	}
+	if got := p.published(); !equalIDs(got, []string{"1", "2", "3"}) {
+		t.Fatalf("unexpected events published %v", got)
+	}
+}
+
+func TestRelayOnceRetry(t *testing.T) {
+	ctx := context.Background()
+	o := NewMemoryOutbox()
+	o.Append(outboxEvents("1", "2", "3")...)
+	p := &recorder{fail: map[int]bool{2: true}}
+	r := NewRelay(o, o, p)
+	n, err := r.RelayOnce(ctx)
+	if err == nil {
+		t.Fatal("expected publish error")
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 event relayed got %d", n)
+	}
+	if seq, _ := o.Sequence(ctx); seq != 1 {
+		t.Fatalf("expected ledger at sequence 1 got %d", seq)
+	}
+	// the failed event is relayed again
+	if n, err = r.RelayOnce(ctx); err != nil || n != 2 {
+		t.Fatalf("expected 2 events relayed got %d, %v", n, err)
+	}
+	if got := p.published(); !equalIDs(got, []string{"1", "2", "3"}) {
+		t.Fatalf("unexpected events published %v", got)
+	}
+}
+
+func TestRelayRunOrdering(t *testing.T) {
+	o := NewMemoryOutbox()
+	o.Append(outboxEvents("1", "2", "3", "4", "5")...)
+	p := &recorder{fail: map[int]bool{3: true, 4: true}}
+	r := NewRelay(o, o, p, RelayBatchSize(2), RelayInterval(time.Millisecond), RelayMaxBackoff(10*time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- r.Run(ctx) }()
+	want := []string{"1", "2", "3", "4", "5"}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(p.published()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	o.Append(outboxEvents("6")...)
+	want = append(want, "6")
+	for len(p.published()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected %v got %v", context.Canceled, err)
+	}
+	if got := p.published(); !equalIDs(got, want) {
+		t.Fatalf("expected events published in order %v got %v", want, got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(5 * time.Second)
+	var got []time.Duration
+	for i := 0; i < 100; i++ {
+		got = append(got, b.next())
+	}
+	for i, want := range []time.Duration{time.Second, time.Second, 2 * time.Second, 3 * time.Second, 5 * time.Second} {
+		if got[i] != want {
+			t.Fatalf("expected delay %d to be %v got %v", i, want, got[i])
+		}
+	}
+	if last := got[len(got)-1]; last != 5*time.Second {
+		t.Fatalf("expected delay capped at 5s got %v", last)
+	}
+	b.reset()
+	if d := b.next(); d != time.Second {
+		t.Fatalf("expected 1s after reset got %v", d)
+	}
+}
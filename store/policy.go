@@ -0,0 +1,339 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+const (
+	defaultSnapshotTrackerSize = 10000
+)
+
+// SnapshotInfo holds what a snapshot policy may need to decide if a snapshot
+// should be taken for the aggregate of the event received
+type SnapshotInfo struct {
+	// Event received
+	Event *pb.Event
+	// LastSnapshotVersion version of the last snapshot of the aggregate, 0 if
+	// it has none, only available for policies requiring the last snapshot
+	LastSnapshotVersion int64
+	// LastSnapshotTime time of the last snapshot of the aggregate, zero if it
+	// has none, only available for policies requiring the last snapshot
+	LastSnapshotTime time.Time
+	// ReplayDuration time spent loading the aggregate up to the event version
+	// since its last snapshot, only available for policies requiring state
+	ReplayDuration time.Duration
+	// StateSize size in bytes of the encoded aggregate state, only available
+	// for policies requiring state
+	StateSize int
+}
+
+// EventsSinceSnapshot returns the number of events appended since the last
+// snapshot
+func (i SnapshotInfo) EventsSinceSnapshot() int64 {
+	return i.Event.Aggregate.GetVersion() - i.LastSnapshotVersion
+}
+
+// SnapshotPolicy decides when a snapshot should be taken
+type SnapshotPolicy interface {
+	ShouldSnapshot(info SnapshotInfo) bool
+	// RequiresState reports if the policy needs the aggregate to be loaded,
+	// filling ReplayDuration and StateSize, before being evaluated
+	RequiresState() bool
+	// RequiresLastSnapshot reports if the policy needs LastSnapshotVersion and
+	// LastSnapshotTime, read from the event store the first time an aggregate
+	// is seen
+	RequiresLastSnapshot() bool
+}
+
+// snapshotPolicyFunc wraps a func so it satisfies the SnapshotPolicy interface
+type snapshotPolicyFunc struct {
+	fn           func(SnapshotInfo) bool
+	stateful     bool
+	lastSnapshot bool
+}
+
+func (p snapshotPolicyFunc) ShouldSnapshot(info SnapshotInfo) bool {
+	return p.fn(info)
+}
+
+func (p snapshotPolicyFunc) RequiresState() bool {
+	return p.stateful
+}
+
+func (p snapshotPolicyFunc) RequiresLastSnapshot() bool {
+	return p.lastSnapshot
+}
+
+// SnapshotPolicyFunc returns a policy from an ordinary function not requiring
+// the aggregate state, but requiring the last snapshot
+func SnapshotPolicyFunc(fn func(SnapshotInfo) bool) SnapshotPolicy {
+	return snapshotPolicyFunc{fn: fn, lastSnapshot: true}
+}
+
+// VersionModulo snapshots when the event version is a multiple of factor. It
+// only reads the event, so the event store is only called to take snapshots
+func VersionModulo(factor int64) SnapshotPolicy {
+	return snapshotPolicyFunc{
+		fn: func(info SnapshotInfo) bool {
+			return IsSnapshotTime(info.Event, factor)
+		},
+	}
+}
+
+// EveryNEvents snapshots when at least n events were appended since the last
+// snapshot, so batched appends skipping a multiple of n still snapshot
+func EveryNEvents(n int64) SnapshotPolicy {
+	return SnapshotPolicyFunc(func(info SnapshotInfo) bool {
+		if n <= 0 {
+			return false
+		}
+		return info.EventsSinceSnapshot() >= n
+	})
+}
+
+// Every snapshots when at least d has elapsed since the last snapshot
+func Every(d time.Duration) SnapshotPolicy {
+	return SnapshotPolicyFunc(func(info SnapshotInfo) bool {
+		if info.EventsSinceSnapshot() <= 0 {
+			return false
+		}
+		return time.Since(info.LastSnapshotTime) >= d
+	})
+}
+
+// ReplayDurationExceeds snapshots when loading the aggregate takes longer than d
+func ReplayDurationExceeds(d time.Duration) SnapshotPolicy {
+	return snapshotPolicyFunc{
+		fn: func(info SnapshotInfo) bool {
+			return info.ReplayDuration > d
+		},
+		stateful: true,
+	}
+}
+
+// StateSizeExceeds snapshots when the encoded aggregate state is bigger than n bytes
+func StateSizeExceeds(n int) SnapshotPolicy {
+	return snapshotPolicyFunc{
+		fn: func(info SnapshotInfo) bool {
+			return info.StateSize > n
+		},
+		stateful: true,
+	}
+}
+
+// AnyOf snapshots when at least one of the policies is satisfied
+func AnyOf(policies ...SnapshotPolicy) SnapshotPolicy {
+	return snapshotPolicyFunc{
+		fn: func(info SnapshotInfo) bool {
+			for _, p := range policies {
+				if p.ShouldSnapshot(info) {
+					return true
+				}
+			}
+			return false
+		},
+		stateful:     anyRequiresState(policies),
+		lastSnapshot: anyRequiresLastSnapshot(policies),
+	}
+}
+
+// AllOf snapshots when every policy is satisfied
+func AllOf(policies ...SnapshotPolicy) SnapshotPolicy {
+	return snapshotPolicyFunc{
+		fn: func(info SnapshotInfo) bool {
+			if len(policies) == 0 {
+				return false
+			}
+			for _, p := range policies {
+				if !p.ShouldSnapshot(info) {
+					return false
+				}
+			}
+			return true
+		},
+		stateful:     anyRequiresState(policies),
+		lastSnapshot: anyRequiresLastSnapshot(policies),
+	}
+}
+
+func anyRequiresState(policies []SnapshotPolicy) bool {
+	for _, p := range policies {
+		if p.RequiresState() {
+			return true
+		}
+	}
+	return false
+}
+
+func anyRequiresLastSnapshot(policies []SnapshotPolicy) bool {
+	for _, p := range policies {
+		if p.RequiresLastSnapshot() {
+			return true
+		}
+	}
+	return false
+}
+
+// -----------------------------------------------------------------------------
+
+// snapshotRecord last snapshot of an aggregate, and the state loaded for the
+// policies requiring it
+type snapshotRecord struct {
+	version int64
+	time    time.Time
+	// state loaded up to stateVersion, nil if not loaded, and the time spent
+	// loading it since the last snapshot
+	state        proto.Message
+	stateVersion int64
+	replay       time.Duration
+}
+
+// snapshotTracker remembers the last snapshot of the most recently used
+// aggregates. Aggregates not tracked yet are seeded from their latest snapshot
+// in the event store
+type snapshotTracker struct {
+	mu  sync.Mutex
+	lru *simplelru.LRU
+}
+
+func newSnapshotTracker(size int) *snapshotTracker {
+	lru, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		panic(err)
+	}
+	return &snapshotTracker{lru: lru}
+}
+
+// get returns the record of the aggregate, reading its latest valid snapshot
+// from the event store if not tracked yet
+func (t *snapshotTracker) get(ctx context.Context, id string, aggregator proto.Message) (snapshotRecord, error) {
+	t.mu.Lock()
+	v, ok := t.lru.Get(id)
+	t.mu.Unlock()
+	if ok {
+		return v.(snapshotRecord), nil
+	}
+	snap, err := NewStore(aggregator).latestSnapshot(ctx, id, time.Time{})
+	if err != nil {
+		return snapshotRecord{}, err
+	}
+	var r snapshotRecord
+	if snap != nil {
+		r.version = snap.Aggregate.GetVersion()
+		if r.time, err = ptypes.Timestamp(snap.GetCreated()); err != nil {
+			return snapshotRecord{}, err
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// keep the record of a snapshot taken meanwhile
+	if v, ok := t.lru.Get(id); ok {
+		return v.(snapshotRecord), nil
+	}
+	t.lru.Add(id, r)
+	return r, nil
+}
+
+// peek returns the record of the aggregate if tracked, without reading its
+// latest snapshot from the event store otherwise
+func (t *snapshotTracker) peek(id string) snapshotRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if v, ok := t.lru.Get(id); ok {
+		return v.(snapshotRecord)
+	}
+	return snapshotRecord{}
+}
+
+// snapped records a snapshot of the aggregate taken at the version
+func (t *snapshotTracker) snapped(id string, version int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var r snapshotRecord
+	if v, ok := t.lru.Peek(id); ok {
+		r = v.(snapshotRecord)
+	}
+	if version < r.version {
+		return
+	}
+	r.version, r.time, r.replay = version, time.Now(), 0
+	t.lru.Add(id, r)
+}
+
+// loaded keeps the state of the aggregate loaded up to the version, unless a
+// newer one is kept already
+func (t *snapshotTracker) loaded(id string, state proto.Message, version int64, replay time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var r snapshotRecord
+	if v, ok := t.lru.Peek(id); ok {
+		r = v.(snapshotRecord)
+	}
+	if r.state != nil && version < r.stateVersion {
+		return
+	}
+	r.state, r.stateVersion, r.replay = state, version, replay
+	t.lru.Add(id, r)
+}
+
+// snapshotInfo returns the snapshot info for the event, reading the last
+// snapshot and loading the aggregate state only when the policy requires them.
+// The store is nil if not loaded
+func snapshotInfo(ctx context.Context, t *snapshotTracker, p SnapshotPolicy, e *pb.Event, aggregator proto.Message, aFn ApplyFn) (SnapshotInfo, *Store, error) {
+	id := e.Aggregate.GetId()
+	info := SnapshotInfo{Event: e}
+	last := t.peek(id)
+	if p.RequiresLastSnapshot() {
+		var err error
+		if last, err = t.get(ctx, id, aggregator); err != nil {
+			return SnapshotInfo{}, nil, err
+		}
+		info.LastSnapshotVersion, info.LastSnapshotTime = last.version, last.time
+	}
+	if !p.RequiresState() {
+		return info, nil, nil
+	}
+	start := time.Now()
+	s, reused, err := loadTrackedState(ctx, last, e, aggregator, aFn)
+	if err != nil {
+		return info, nil, err
+	}
+	info.ReplayDuration = time.Since(start)
+	if reused {
+		info.ReplayDuration += last.replay
+	}
+	info.StateSize = proto.Size(s.State.(proto.Message))
+	t.loaded(id, s.State.(proto.Message), s.Version, info.ReplayDuration)
+	return info, s, nil
+}
+
+// loadTrackedState loads the aggregate up to the event version, only loading
+// the events following the state already loaded for a previous event when
+// there is one. It reports if that state was reused
+func loadTrackedState(ctx context.Context, r snapshotRecord, e *pb.Event, aggregator proto.Message, aFn ApplyFn) (*Store, bool, error) {
+	version := e.Aggregate.GetVersion()
+	if r.state == nil || r.stateVersion > version {
+		s, err := loadSnapshotState(ctx, e, aggregator, aFn)
+		return s, false, err
+	}
+	// the state kept is shared, so events are applied to a copy of it
+	s := NewStore(proto.Clone(r.state))
+	s.Version = r.stateVersion
+	s.LowestVersion = r.stateVersion + 1
+	s.HighestVersion = version
+	if s.Version == version {
+		return s, true, nil
+	}
+	if err := s.LoadEvents(ctx, e.Aggregate.GetId(), aFn); err != nil {
+		return nil, false, err
+	}
+	return s, true, nil
+}
@@ -0,0 +1,122 @@
+package store_test
+
+import (
+	"testing"
+	"time"
+
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/aukbit/pluto-event-source/storetest"
+	"github.com/golang/protobuf/proto"
+)
+
+// counter is an aggregate state holding the version of the last event
+// applied, counting the events applied
+type counter struct {
+	applied int
+}
+
+func (c *counter) apply(e *pb.Event, state interface{}) (interface{}, error) {
+	c.applied++
+	a := proto.Clone(state.(proto.Message)).(*pb.Aggregate)
+	a.Version = e.Aggregate.GetVersion()
+	return a, nil
+}
+
+// appendEvents appends n events to the aggregate, running the action with
+// each of them
+func appendEvents(t *testing.T, h *storetest.Harness, id string, n int, action store.Action) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		h.Given(id).WhenEvent(action, storetest.Event("counted", &pb.Aggregate{})).ThenNoError()
+	}
+}
+
+// snapshotVersion returns the version of the latest snapshot of the aggregate
+func snapshotVersion(t *testing.T, h *storetest.Harness, id string) int64 {
+	t.Helper()
+	s := store.NewStore(&pb.Aggregate{})
+	if _, err := s.LoadSnapshot(h.Context(), id); err != nil {
+		t.Fatal(err)
+	}
+	return s.Version
+}
+
+// versionIs snapshots at the version
+func versionIs(v int64) store.SnapshotPolicy {
+	return store.SnapshotPolicyFunc(func(info store.SnapshotInfo) bool {
+		return info.Event.Aggregate.GetVersion() == v
+	})
+}
+
+func TestSnapshotPolicySeededFromEventStore(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	c := &counter{}
+	appendEvents(t, h, "1", 3, store.SnapshotPolicyActionWrapper(&pb.Aggregate{}, c.apply, versionIs(3)))
+	if v := snapshotVersion(t, h, "1"); v != 3 {
+		t.Fatalf("expected snapshot at version 3 got %d", v)
+	}
+	// a new wrapper, as after a restart, knows about the snapshot taken
+	action := store.SnapshotPolicyActionWrapper(&pb.Aggregate{}, c.apply, store.EveryNEvents(5))
+	appendEvents(t, h, "1", 4, action)
+	if v := snapshotVersion(t, h, "1"); v != 3 {
+		t.Fatalf("expected no snapshot before version 8 got %d", v)
+	}
+	appendEvents(t, h, "1", 1, action)
+	if v := snapshotVersion(t, h, "1"); v != 8 {
+		t.Fatalf("expected snapshot at version 8 got %d", v)
+	}
+	action = store.SnapshotPolicyActionWrapper(&pb.Aggregate{}, c.apply, store.Every(time.Hour))
+	appendEvents(t, h, "1", 1, action)
+	if v := snapshotVersion(t, h, "1"); v != 8 {
+		t.Fatalf("expected no snapshot within an hour of the last one got %d", v)
+	}
+}
+
+func TestSnapshotPolicyReusesState(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	c := &counter{}
+	var infos []store.SnapshotInfo
+	policy := store.AnyOf(store.StateSizeExceeds(1<<20), store.SnapshotPolicyFunc(func(info store.SnapshotInfo) bool {
+		infos = append(infos, info)
+		return false
+	}))
+	appendEvents(t, h, "1", 5, store.SnapshotPolicyActionWrapper(&pb.Aggregate{}, c.apply, policy))
+	if c.applied != 5 {
+		t.Fatalf("expected each event applied once got %d events applied", c.applied)
+	}
+	for i := 1; i < len(infos); i++ {
+		if infos[i].ReplayDuration < infos[i-1].ReplayDuration {
+			t.Fatalf("expected replay duration to grow since the last snapshot got %v after %v",
+				infos[i].ReplayDuration, infos[i-1].ReplayDuration)
+		}
+	}
+	if infos[4].StateSize == 0 {
+		t.Fatal("expected state size of the loaded state")
+	}
+}
+
+func TestSnapshotPolicyWithoutLastSnapshot(t *testing.T) {
+	// no event store client, so any call to the event store fails
+	ctx := pluto.New(pluto.Name("policy_test")).WithContext(context.Background())
+	e := storetest.Event("counted", &pb.Aggregate{})
+	e.Aggregate.Id, e.Aggregate.Version = "1", 1
+	c := &counter{}
+	if err := store.SnapshotActionWrapper(&pb.Aggregate{}, c.apply, 5)(ctx, e); err != nil {
+		t.Fatalf("expected event store only called at snapshot time got %v", err)
+	}
+	if err := store.SnapshotPolicyActionWrapper(&pb.Aggregate{}, c.apply, store.EveryNEvents(5))(ctx, e); err == nil {
+		t.Fatal("expected last snapshot read from the event store")
+	}
+	if p := store.AnyOf(store.VersionModulo(5), store.StateSizeExceeds(1)); p.RequiresLastSnapshot() {
+		t.Fatal("expected policies not reading the last snapshot not to require it")
+	}
+	if p := store.AllOf(store.VersionModulo(5), store.Every(time.Hour)); !p.RequiresLastSnapshot() {
+		t.Fatal("expected policies reading the last snapshot to require it")
+	}
+}
@@ -0,0 +1,165 @@
+package store
+
+import (
+	"container/heap"
+	"sync"
+
+	context "golang.org/x/net/context"
+)
+
+// topicPriorities holds the priority of the events of each topic, topics not
+// registered have the highest priority, 0
+var topicPriorities = struct {
+	sync.RWMutex
+	m map[string]int32
+}{m: make(map[string]int32)}
+
+// SetTopicPriority sets the priority of the events of the topic dispatched by
+// Aggregate and AppendExpected, where 0 is the highest priority
+func SetTopicPriority(topic string, priority int32) {
+	topicPriorities.Lock()
+	defer topicPriorities.Unlock()
+	topicPriorities.m[topic] = priority
+}
+
+type priorityContextKey struct{}
+
+// WithPriority returns a copy of parent ctx in which the events dispatched
+// have the priority, overriding the priority of their topic
+func WithPriority(ctx context.Context, priority int32) context.Context {
+	return context.WithValue(ctx, priorityContextKey{}, priority)
+}
+
+// contextPriority returns the priority set by WithPriority, if any
+func contextPriority(ctx context.Context) (int32, bool) {
+	p, ok := ctx.Value(priorityContextKey{}).(int32)
+	return p, ok
+}
+
+// eventPriority returns the priority of an event of the topic
+func eventPriority(ctx context.Context, topic string) int32 {
+	if p, ok := contextPriority(ctx); ok {
+		return p
+	}
+	topicPriorities.RLock()
+	defer topicPriorities.RUnlock()
+	return topicPriorities.m[topic]
+}
+
+// -----------------------------------------------------------------------------
+
+// PriorityWorkers limits the number of messages processed at once to n across
+// all the topics subscribed. Messages waiting are processed by event priority,
+// so urgent events are not stuck behind bulk ones. Subscription flow control
+// should allow more outstanding messages than n for priorities to be honoured
+func PriorityWorkers(n int) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.workers = n
+	}
+}
+
+// prioritySemaphore returns the semaphore for the configured workers, or nil
+// if messages are processed as soon as they are received
+func (c subscribeConfig) prioritySemaphore() *prioritySemaphore {
+	if c.workers <= 0 {
+		return nil
+	}
+	return newPrioritySemaphore(c.workers)
+}
+
+// -----------------------------------------------------------------------------
+
+// prioritySemaphore grants its slots to the waiter with the highest priority,
+// and to the first one arriving among waiters with the same priority
+type prioritySemaphore struct {
+	mu      sync.Mutex
+	free    int
+	seq     int64
+	waiters waiterHeap
+}
+
+func newPrioritySemaphore(n int) *prioritySemaphore {
+	return &prioritySemaphore{free: n}
+}
+
+// acquire blocks until a slot is granted or ctx is done
+func (s *prioritySemaphore) acquire(ctx context.Context, priority int32) error {
+	s.mu.Lock()
+	if s.free > 0 && len(s.waiters) == 0 {
+		s.free--
+		s.mu.Unlock()
+		return nil
+	}
+	w := &waiter{priority: priority, seq: s.seq, ready: make(chan struct{})}
+	s.seq++
+	heap.Push(&s.waiters, w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		if w.index >= 0 {
+			heap.Remove(&s.waiters, w.index)
+			s.mu.Unlock()
+			return ctx.Err()
+		}
+		s.mu.Unlock()
+		// the slot was granted meanwhile
+		s.release()
+		return ctx.Err()
+	}
+}
+
+// release gives the slot to the next waiter, if any
+func (s *prioritySemaphore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.waiters) == 0 {
+		s.free++
+		return
+	}
+	w := heap.Pop(&s.waiters).(*waiter)
+	close(w.ready)
+}
+
+type waiter struct {
+	priority int32
+	seq      int64
+	index    int
+	ready    chan struct{}
+}
+
+// waiterHeap implements heap.Interface
+type waiterHeap []*waiter
+
+func (h waiterHeap) Len() int { return len(h) }
+
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *waiterHeap) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *waiterHeap) Pop() interface{} {
+	old := *h
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*h = old[:len(old)-1]
+	return w
+}
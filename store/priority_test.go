@@ -0,0 +1,100 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+)
+
+// waiting returns the number of waiters of the semaphore
+func (s *prioritySemaphore) waiting() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.waiters)
+}
+
+// waitWaiting waits until the semaphore has n waiters
+func waitWaiting(t *testing.T, s *prioritySemaphore, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.waiting() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d waiters got %d", n, s.waiting())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPrioritySemaphoreOrdering(t *testing.T) {
+	ctx := context.Background()
+	s := newPrioritySemaphore(1)
+	if err := s.acquire(ctx, 9); err != nil {
+		t.Fatal(err)
+	}
+	granted := make(chan int, 4)
+	for i, p := range []int32{5, 1, 3, 1} {
+		go func(i int, p int32) {
+			if err := s.acquire(ctx, p); err != nil {
+				t.Error(err)
+				return
+			}
+			granted <- i
+		}(i, p)
+		waitWaiting(t, s, i+1)
+	}
+	// highest priority first, by arrival among the same priority
+	for _, want := range []int{1, 3, 2, 0} {
+		s.release()
+		if got := <-granted; got != want {
+			t.Fatalf("expected waiter %d granted got %d", want, got)
+		}
+	}
+	s.release()
+	if s.free != 1 {
+		t.Fatalf("expected slot free got %d", s.free)
+	}
+}
+
+func TestPrioritySemaphoreCancel(t *testing.T) {
+	s := newPrioritySemaphore(1)
+	if err := s.acquire(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.acquire(ctx, 0) }()
+	waitWaiting(t, s, 1)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected %v got %v", context.Canceled, err)
+	}
+	if n := s.waiting(); n != 0 {
+		t.Fatalf("expected waiter cancelled to be removed got %d waiters", n)
+	}
+	// the slot released is free again, not granted to the waiter cancelled
+	s.release()
+	if s.free != 1 {
+		t.Fatalf("expected slot free got %d", s.free)
+	}
+	if err := s.acquire(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAppendedEventPriority(t *testing.T) {
+	SetTopicPriority("priority_test", 5)
+	ctx := context.Background()
+	if p := appendedEvent(ctx, "1", 0, &pb.Event{Topic: "priority_test", OriginName: "test"}).GetPriority(); p != 5 {
+		t.Fatalf("expected topic priority 5 got %d", p)
+	}
+	if p := appendedEvent(ctx, "1", 0, &pb.Event{Topic: "priority_test", OriginName: "test", Priority: 2}).GetPriority(); p != 2 {
+		t.Fatalf("expected event priority 2 got %d", p)
+	}
+	ctx = WithPriority(ctx, 0)
+	if p := appendedEvent(ctx, "1", 0, &pb.Event{Topic: "priority_test", OriginName: "test", Priority: 2}).GetPriority(); p != 0 {
+		t.Fatalf("expected priority 0 set by WithPriority got %d", p)
+	}
+}
@@ -3,7 +3,6 @@ package store
 import (
 	// "context"
 
-	"fmt"
 	"os"
 	"strings"
 
@@ -22,7 +21,8 @@ type Action func(context.Context, *pb.Event) error
 type Topics map[string][]Action
 
 // Subscribe for topics available from a redis configuration
-func Subscribe(client *pubsub.Client, name string, topics Topics) pluto.HookFunc {
+func Subscribe(client *pubsub.Client, name string, topics Topics, opts ...SubscribeOption) pluto.HookFunc {
+	cfg := newSubscribeConfig(opts...)
 	return func(ctx context.Context) error {
 		l := zerolog.Ctx(ctx)
 		// Set project environment as topic prefix eg. development.event_created
@@ -31,26 +31,31 @@ func Subscribe(client *pubsub.Client, name string, topics Topics) pluto.HookFunc
 			return errGcpProjectEnvironmentNotDefined
 		}
 		l.Info().Msgf("subscribe to topics: %v", topics)
-		//
+		sem := cfg.prioritySemaphore()
 		for t, actions := range topics {
-			t = strings.ToLower(t)
-			topic, err := GetOrCreateTopic(ctx, client, t)
+			sub, err := subscribeTopic(ctx, client, env, name, t, nil)
 			if err != nil {
 				return err
 			}
-			// update topic labels
-			_, err = UpdateTopic(ctx, topic)
-			if err != nil {
-				return err
-			}
-			// subscribe
-			n := fmt.Sprintf("%s.%s.%s", env, name, t)
-			sub, err := GetOrCreateSubscription(ctx, client, n, topic)
-			if err != nil {
-				return err
-			}
-			go pullMsgsFromSubscription(ctx, sub, actions)
+			go pullMsgsFromSubscription(ctx, sub, actions, nil, cfg, sem)
 		}
 		return nil
 	}
 }
+
+// subscribeTopic gets or creates the topic and the subscription of the
+// service to it, created with the labels given
+func subscribeTopic(ctx context.Context, client *pubsub.Client, env, name, t string, labels map[string]string) (*pubsub.Subscription, error) {
+	t = strings.ToLower(t)
+	topic, err := GetOrCreateTopic(ctx, client, t)
+	if err != nil {
+		return nil, err
+	}
+	// update topic labels
+	_, err = UpdateTopic(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+	// subscribe
+	return getOrCreateSubscription(ctx, client, SubscriptionName(env, name, t), topic, labels)
+}
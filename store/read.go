@@ -0,0 +1,65 @@
+package store
+
+import (
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+)
+
+const (
+	defaultPageSize = 100
+)
+
+// EventPage holds a page of events read across aggregates
+type EventPage struct {
+	Events []*pb.Event
+	// NextSequence is the AfterSequence of the query for the next page,
+	// 0 when there are no more events
+	NextSequence int64
+}
+
+// ReadEvents reads a page of events across all aggregates in global order,
+// filtered by topic, schema and creation time. The page size is given by the
+// query Limit and the page start by its AfterSequence. The aggregate data of
+// the events is decoded, see EventIterator
+func ReadEvents(ctx context.Context, q EventQuery) (*EventPage, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultPageSize
+	}
+	it, err := NewEventIterator(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	page := &EventPage{}
+	for it.Next() {
+		page.Events = append(page.Events, it.Event())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	if it.received >= q.Limit && it.lastSequence > q.AfterSequence {
+		page.NextSequence = it.lastSequence
+	}
+	return page, nil
+}
+
+// ForEachEvent reads every event matching the query page by page, calling fn
+// for each of them in global order until fn returns an error
+func ForEachEvent(ctx context.Context, q EventQuery, fn func(*pb.Event) error) error {
+	for {
+		page, err := ReadEvents(ctx, q)
+		if err != nil {
+			return err
+		}
+		for _, e := range page.Events {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		if page.NextSequence == 0 {
+			return nil
+		}
+		q.AfterSequence = page.NextSequence
+	}
+}
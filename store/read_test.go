@@ -0,0 +1,117 @@
+package store_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/aukbit/pluto-event-source/storetest"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestReadEventsDecoded(t *testing.T) {
+	prev := store.DefaultKeyStore
+	store.DefaultKeyStore = store.NewMemoryKeyStore()
+	defer func() { store.DefaultKeyStore = prev }()
+	h := storetest.New(t)
+	defer h.Close()
+	e := storetest.Event("counted", &pb.Aggregate{Id: "secret"})
+	if _, err := store.AppendExpected(h.Context(), "1", store.ExpectNotExists, e); err != nil {
+		t.Fatal(err)
+	}
+	if stored := h.Events("1")[0]; stored.Aggregate.Metadata[store.EncryptionMetadataKey] == "" {
+		t.Fatal("expected event stored encrypted")
+	}
+	page, err := store.ReadEvents(h.Context(), store.EventQuery{Topics: []string{"counted"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Events) != 1 {
+		t.Fatalf("expected 1 event got %d", len(page.Events))
+	}
+	got := page.Events[0]
+	if got.Aggregate.Metadata[store.EncryptionMetadataKey] != "" {
+		t.Fatal("expected event read decrypted")
+	}
+	out := &pb.Aggregate{}
+	if err := proto.Unmarshal(got.Aggregate.Data, out); err != nil || out.Id != "secret" {
+		t.Fatalf("expected decoded data got %v, %v", out, err)
+	}
+}
+
+// ids returns the aggregate id and version of the events
+func ids(events []*pb.Event) string {
+	var out []string
+	for _, e := range events {
+		out = append(out, fmt.Sprintf("%s/%d", e.Aggregate.GetId(), e.Aggregate.GetVersion()))
+	}
+	return fmt.Sprint(out)
+}
+
+func TestReadEventsPaging(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	for _, id := range []string{"1", "2", "1", "3", "2"} {
+		h.Append(id, storetest.Event("counted", &pb.Aggregate{}))
+	}
+	h.Append("1", storetest.Event("other", &pb.Aggregate{}))
+	q := store.EventQuery{Topics: []string{"counted"}, Limit: 2}
+	var pages []string
+	for {
+		page, err := store.ReadEvents(h.Context(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, fmt.Sprintf("%s next %d", ids(page.Events), page.NextSequence))
+		if page.NextSequence == 0 {
+			break
+		}
+		q.AfterSequence = page.NextSequence
+	}
+	want := "[[1/1 2/1] next 2 [1/2 3/1] next 4 [2/2] next 0]"
+	if got := fmt.Sprint(pages); got != want {
+		t.Fatalf("expected pages %s got %s", want, got)
+	}
+}
+
+func TestForEachEvent(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < 5; i++ {
+		h.Append("1", eventAt(start.Add(time.Duration(i)*time.Minute)))
+	}
+	var got []*pb.Event
+	collect := func(e *pb.Event) error {
+		got = append(got, e)
+		return nil
+	}
+	if err := store.ForEachEvent(h.Context(), store.EventQuery{Limit: 2}, collect); err != nil {
+		t.Fatal(err)
+	}
+	if ids(got) != "[1/1 1/2 1/3 1/4 1/5]" {
+		t.Fatalf("expected every event in order got %s", ids(got))
+	}
+	got = nil
+	q := store.EventQuery{Limit: 2, CreatedFrom: start.Add(time.Minute), CreatedTo: start.Add(3 * time.Minute)}
+	if err := store.ForEachEvent(h.Context(), q, collect); err != nil {
+		t.Fatal(err)
+	}
+	if ids(got) != "[1/2 1/3 1/4]" {
+		t.Fatalf("expected events created within the range got %s", ids(got))
+	}
+	stop := errors.New("stop")
+	n := 0
+	err := store.ForEachEvent(h.Context(), store.EventQuery{Limit: 2}, func(e *pb.Event) error {
+		if n++; n == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 3 {
+		t.Fatalf("expected error of fn after 3 events got %v after %d", err, n)
+	}
+}
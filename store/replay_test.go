@@ -0,0 +1,45 @@
+package store_test
+
+import (
+	"testing"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto-event-source/eventstore"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/aukbit/pluto-event-source/storetest"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestAggregateStrictReplay(t *testing.T) {
+	// a log missing version 3 of the aggregate
+	events := eventstore.NewMemoryLog()
+	for _, v := range []int64{1, 2, 4} {
+		data, err := proto.Marshal(&pb.Event{Topic: "counted", Aggregate: &pb.Aggregate{Id: "1", Version: v}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := events.Append(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	es, err := eventstore.New(events, eventstore.NewMemoryLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := storetest.NewWith(t, es)
+	defer h.Close()
+
+	ctx := store.WithReplayMode(h.Context(), store.ReplayStrict)
+	c := &counter{}
+	_, err = store.Aggregate(ctx, &pb.Aggregate{}, "1", &pb.Aggregate{}, "counted", nil, c.apply)
+	cerr, ok := err.(*store.CorruptionError)
+	if !ok {
+		t.Fatalf("expected *CorruptionError got %v", err)
+	}
+	if cerr.AggregateID != "1" || cerr.Expected != 3 || cerr.Got != 4 {
+		t.Fatalf("expected version 3 missing got %v", cerr)
+	}
+	if got := len(h.Events("1")); got != 3 {
+		t.Fatalf("expected no event dispatched got %d events", got)
+	}
+}
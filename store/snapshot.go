@@ -2,12 +2,19 @@ package store
 
 import (
 	"fmt"
+	"time"
 
 	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	pb "github.com/aukbit/event-source-proto/es"
 	"github.com/aukbit/pluto"
+	"github.com/aukbit/pluto/client"
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
 )
 
 // -----------------------------------------------------------------------------
@@ -15,8 +22,27 @@ import (
 const (
 	// SnapshotCreated topic
 	SnapshotCreated = "snapshot_created"
+
+	// SnapshotVersionMetadataKey constant to be used as the key in Aggregate
+	// Metadata holding the snapshot version declared by the aggregator
+	SnapshotVersionMetadataKey string = "snapshot_version"
 )
 
+// SnapshotVersioner is implemented by aggregators declaring the version of
+// their snapshots. The version must change whenever the aggregator proto or
+// its apply function change in a way that makes previous snapshots invalid
+type SnapshotVersioner interface {
+	SnapshotVersion() string
+}
+
+// snapshotVersion returns the snapshot version declared by the aggregator
+func snapshotVersion(aggregator interface{}) string {
+	if v, ok := aggregator.(SnapshotVersioner); ok {
+		return v.SnapshotVersion()
+	}
+	return ""
+}
+
 // IsSnapshotTime validate if event version is valid to be used as snapshot based on
 // input factor
 func IsSnapshotTime(e *pb.Event, factor int64) bool {
@@ -31,17 +57,27 @@ func IsSnapshotTime(e *pb.Event, factor int64) bool {
 
 // TakeSnapshot loads an agregator up to current state and triggers a snapshot
 func TakeSnapshot(ctx context.Context, e *pb.Event, aggregator proto.Message, aFn ApplyFn) error {
+	s, err := loadSnapshotState(ctx, e, aggregator, aFn)
+	if err != nil {
+		return err
+	}
+	return snapStore(ctx, e, s, aggregator)
+}
 
+// loadSnapshotState loads an agregator up to the event version
+func loadSnapshotState(ctx context.Context, e *pb.Event, aggregator proto.Message, aFn ApplyFn) (*Store, error) {
 	// Initialize new store
 	s := NewStore(aggregator)
-	// Define version interval
-	s.LowestVersion = 1
 	s.HighestVersion = e.Aggregate.GetVersion()
-	// Load events from event store
-	if err := s.LoadEvents(ctx, e.Aggregate.GetId(), aFn); err != nil {
-		return err
+	// Load the latest snapshot and the events following it
+	if err := s.Load(ctx, e.Aggregate.GetId(), aFn); err != nil {
+		return nil, err
 	}
+	return s, nil
+}
 
+// snapStore triggers a snapshot of the loaded store state
+func snapStore(ctx context.Context, e *pb.Event, s *Store, aggregator proto.Message) error {
 	// Encodes aggregator state to proto message
 	data, err := s.Marshal()
 	if err != nil {
@@ -58,6 +94,9 @@ func TakeSnapshot(ctx context.Context, e *pb.Event, aggregator proto.Message, aF
 			Format:  pb.Aggregate_PROTOBUF,
 			Data:    data,
 			Version: e.Aggregate.GetVersion(),
+			Metadata: map[string]string{
+				SnapshotVersionMetadataKey: snapshotVersion(aggregator),
+			},
 		},
 
 		OriginName: pluto.FromContext(ctx).Name(),
@@ -71,3 +110,127 @@ func TakeSnapshot(ctx context.Context, e *pb.Event, aggregator proto.Message, aF
 
 	return nil
 }
+
+// LoadSnapshot loads the latest snapshot of the aggregate up to HighestVersion
+// into the store. Snapshots of another schema or snapshot version are ignored
+// so events are fully replayed instead. It returns true if a snapshot was
+// loaded, in which case LowestVersion is moved to the version following it
+func (s *Store) LoadSnapshot(ctx context.Context, id string) (bool, error) {
+	return s.loadSnapshot(ctx, id, time.Time{})
+}
+
+// loadSnapshot loads the latest snapshot created at or before asOf, zero
+// meaning the latest of all
+func (s *Store) loadSnapshot(ctx context.Context, id string, asOf time.Time) (bool, error) {
+	snap, err := s.latestSnapshot(ctx, id, asOf)
+	if err != nil || snap == nil {
+		return false, err
+	}
+	state := proto.Clone(s.State.(proto.Message))
+	state.Reset()
+	if err := UnmarshalEventDataContext(ctx, snap, state); err != nil {
+		return false, err
+	}
+	s.State = state
+	s.Version = snap.Aggregate.GetVersion()
+	s.LowestVersion = s.Version + 1
+	return true, nil
+}
+
+// latestSnapshot returns the latest valid snapshot of the aggregate up to
+// HighestVersion created at or before asOf, nil if there is none
+func (s *Store) latestSnapshot(ctx context.Context, id string, asOf time.Time) (*pb.Event, error) {
+	l := zerolog.Ctx(ctx)
+	c, ok := pluto.FromContext(ctx).Client(EventSourceQueryClientName)
+	if !ok {
+		return nil, errors.Wrap(errEventSourceClientNotAvailable, EventSourceQueryClientName)
+	}
+	conn, err := c.Dial(client.Timeout(2 * time.Second))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// The projection returns the latest snapshot of the aggregate up to the
+	// version and creation time requested, zero values meaning the latest of all
+	req := &pb.Event{
+		Topic: SnapshotCreated,
+		Aggregate: &pb.Aggregate{
+			Id:      id,
+			Schema:  fmt.Sprintf("%T", s.State),
+			Version: s.HighestVersion,
+		},
+	}
+	if !asOf.IsZero() {
+		if req.Created, err = ptypes.TimestampProto(asOf); err != nil {
+			return nil, err
+		}
+	}
+	snap, err := c.Stub(conn).(pb.EventSourceProjectionClient).Get(ctx, req)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !s.isValidSnapshot(snap) || !createdAtOrBefore(snap, asOf) {
+		l.Warn().Msgf("snapshot %s version %d of %s ignored, expected snapshot version %q got %q",
+			snap.Aggregate.GetSchema(), snap.Aggregate.GetVersion(), id,
+			snapshotVersion(s.State), snap.Aggregate.GetMetadata()[SnapshotVersionMetadataKey])
+		return nil, nil
+	}
+	return snap, nil
+}
+
+// isValidSnapshot validates the snapshot matches the store aggregator
+func (s *Store) isValidSnapshot(snap *pb.Event) bool {
+	if snap.GetAggregate() == nil || snap.Aggregate.GetVersion() == 0 {
+		return false
+	}
+	if s.HighestVersion != 0 && snap.Aggregate.GetVersion() > s.HighestVersion {
+		return false
+	}
+	if snap.Aggregate.GetSchema() != fmt.Sprintf("%T", s.State) {
+		return false
+	}
+	return snap.Aggregate.GetMetadata()[SnapshotVersionMetadataKey] == snapshotVersion(s.State)
+}
+
+// Load loads the store from the latest valid snapshot followed by the events
+// appended after it, or by replaying all events if there is no valid snapshot
+func (s *Store) Load(ctx context.Context, id string, fn ApplyFn) error {
+	if _, err := s.LoadSnapshot(ctx, id); err != nil {
+		return err
+	}
+	return s.LoadEvents(ctx, id, fn)
+}
+
+// RegenerateSnapshots replays all events of every aggregate with events
+// matching the query and takes a new snapshot at its current version. The
+// query selects the aggregates of the aggregator type, e.g. by the topic or
+// schema of the event creating them. It should be used to replace the
+// snapshots of an aggregator after its snapshot version changes, and returns
+// the number of snapshots taken
+func RegenerateSnapshots(ctx context.Context, aggregator proto.Message, aFn ApplyFn, q EventQuery) (int, error) {
+	l := zerolog.Ctx(ctx)
+	seen := make(map[string]bool)
+	taken := 0
+	err := ForEachEvent(ctx, q, func(e *pb.Event) error {
+		id := e.GetAggregate().GetId()
+		if seen[id] {
+			return nil
+		}
+		seen[id] = true
+		s := NewStore(aggregator)
+		if err := s.LoadEvents(ctx, id, aFn); err != nil {
+			return errors.Wrap(err, id)
+		}
+		snap := &pb.Event{Aggregate: &pb.Aggregate{Id: id, Version: s.Version}}
+		if err := snapStore(ctx, snap, s, aggregator); err != nil {
+			return errors.Wrap(err, id)
+		}
+		taken++
+		l.Info().Msgf("snapshot of %s regenerated at version %d", id, s.Version)
+		return nil
+	})
+	return taken, err
+}
@@ -0,0 +1,82 @@
+package store_test
+
+import (
+	"testing"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/aukbit/pluto-event-source/storetest"
+)
+
+// snapshotAt appends n events to the aggregate and takes a snapshot after them
+func snapshotAt(t *testing.T, h *storetest.Harness, id string, n int, c *counter) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		h.Append(id, storetest.Event("counted", &pb.Aggregate{}))
+	}
+	events := h.Events(id)
+	if err := store.TakeSnapshot(h.Context(), events[len(events)-1], &pb.Aggregate{}, c.apply); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAggregateLoadsSnapshot(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	c := &counter{}
+	snapshotAt(t, h, "1", 3, c)
+	h.Append("1", storetest.Event("counted", &pb.Aggregate{}))
+	c.applied = 0
+	s, err := store.Aggregate(h.Context(), &pb.Aggregate{}, "1", &pb.Aggregate{}, "counted", nil, c.apply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the event after the snapshot and the one dispatched
+	if c.applied != 2 {
+		t.Fatalf("expected 2 events applied got %d", c.applied)
+	}
+	if s.Version != 4 {
+		t.Fatalf("expected state at version 4 got %d", s.Version)
+	}
+}
+
+func TestActionWrapperLoadsSnapshot(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	c := &counter{}
+	r := &storetest.HookRecorder{}
+	action := store.ActionWrapper(&pb.Aggregate{}, c.apply, r.Hook)
+	h.Given("1").WhenEvent(action, storetest.Event("counted", &pb.Aggregate{})).
+		ThenNoError().
+		ThenHookCalled(r, &pb.Aggregate{}, &pb.Aggregate{Version: 1})
+	snapshotAt(t, h, "1", 3, c)
+	c.applied = 0
+	h.Given("1").WhenEvent(action, storetest.Event("counted", &pb.Aggregate{})).
+		ThenNoError().
+		ThenHookCalled(r, &pb.Aggregate{Version: 4}, &pb.Aggregate{Version: 5})
+	// only the event received is applied on top of the snapshot
+	if c.applied != 1 {
+		t.Fatalf("expected 1 event applied got %d", c.applied)
+	}
+}
+
+func TestRegenerateSnapshots(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	c := &counter{}
+	h.Append("1", storetest.Event("counted", &pb.Aggregate{}), storetest.Event("counted", &pb.Aggregate{}))
+	h.Append("2", storetest.Event("counted", &pb.Aggregate{}))
+	h.Append("3", storetest.Event("other", &pb.Aggregate{}))
+	n, err := store.RegenerateSnapshots(h.Context(), &pb.Aggregate{}, c.apply, store.EventQuery{Topics: []string{"counted"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 snapshots taken got %d", n)
+	}
+	for id, want := range map[string]int64{"1": 2, "2": 1, "3": 0} {
+		if v := snapshotVersion(t, h, id); v != want {
+			t.Fatalf("expected snapshot of %s at version %d got %d", id, want, v)
+		}
+	}
+}
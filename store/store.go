@@ -2,12 +2,15 @@ package store
 
 import (
 	"context"
-	"io"
-	"strconv"
+	"fmt"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	pb "github.com/aukbit/event-source-proto/es"
 	"github.com/aukbit/pluto"
@@ -29,6 +32,32 @@ const (
 
 	// LowestVersionQueryKey constant to be used as the key in Query Params
 	LowestVersionQueryKey string = "LV"
+
+	// SequenceQueryKey constant to be used as the key in Query Params to list
+	// events appended after a global sequence number
+	SequenceQueryKey string = "SEQ"
+
+	// TopicQueryKey constant to be used as the key in Query Params to list
+	// events of a comma separated list of topics
+	TopicQueryKey string = "TOPIC"
+
+	// SchemaQueryKey constant to be used as the key in Query Params
+	SchemaQueryKey string = "SCHEMA"
+
+	// CreatedFromQueryKey constant to be used as the key in Query Params to list
+	// events created at or after a RFC3339 timestamp
+	CreatedFromQueryKey string = "CF"
+
+	// CreatedToQueryKey constant to be used as the key in Query Params to list
+	// events created at or before a RFC3339 timestamp
+	CreatedToQueryKey string = "CT"
+
+	// LimitQueryKey constant to be used as the key in Query Params
+	LimitQueryKey string = "LIMIT"
+
+	// SequenceMetadataKey constant to be used as the key in Event Metadata
+	// holding the global sequence number assigned by the event store
+	SequenceMetadataKey string = "seq"
 )
 
 var (
@@ -41,6 +70,11 @@ type Store struct {
 	Version        int64
 	HighestVersion int64
 	LowestVersion  int64
+	// Mode defines how version inconsistencies are handled while loading,
+	// unless set in the context by WithReplayMode
+	Mode ReplayMode
+	// keys holds the version of the events loaded with an idempotency key
+	keys map[string]int64
 }
 
 // ApplyFn defines type for apply functions
@@ -55,49 +89,49 @@ func NewStore(aggregator interface{}) *Store {
 }
 
 // LoadEvents stream events by aggregator id and apply the required changes
-// TODO: use snapshots
-func (s *Store) LoadEvents(ctx context.Context, id string, fn ApplyFn) error {
-	//
-	c, ok := pluto.FromContext(ctx).Client(EventSourceQueryClientName)
-	if !ok {
-		return errors.Wrap(errEventSourceClientNotAvailable, EventSourceQueryClientName)
-	}
-	conn, err := c.Dial(client.Timeout(2 * time.Second))
+// Use Load to start from the latest snapshot
+func (s *Store) LoadEvents(ctx context.Context, id string, fn ApplyFn) (err error) {
+	ctx, span := trace.StartSpan(ctx, "store.LoadEvents")
+	span.AddAttributes(trace.StringAttribute("aggregate_id", id))
+	defer func() { endSpan(span, err) }()
+	start, replayed := time.Now(), int64(0)
+	defer func(schema string) {
+		recordMeasures(ctx, map[tag.Key]string{KeySchema: schema},
+			MEventsReplayed.M(replayed), MLoadLatency.M(sinceInMilliseconds(start)))
+	}(fmt.Sprintf("%T", s.State))
+	it, err := NewEventIterator(ctx, EventQuery{
+		AggregateID:    id,
+		LowestVersion:  s.LowestVersion,
+		HighestVersion: s.HighestVersion,
+	})
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-	// Define query parameters
-	params := make(map[string]string)
-	params[AggregatorIDQueryKey] = id
-	if s.HighestVersion != 0 {
-		params[HighestVersionQueryKey] = strconv.FormatInt(s.HighestVersion, 10)
-	}
-	if s.LowestVersion != 0 {
-		params[LowestVersionQueryKey] = strconv.FormatInt(s.LowestVersion, 10)
-	}
-	// List
-	stream, err := c.Stub(conn).(pb.EventSourceProjectionClient).List(ctx, &pb.Query{Params: params})
-	if err != nil {
-		return err
-	}
-	for {
-		event, err := stream.Recv()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
+	defer it.Close()
+	vc := s.newVersionChecker(ctx, id)
+	for it.Next() {
+		e := it.Event()
+		if err := vc.check(ctx, e); err != nil {
 			return err
 		}
-		if err := s.apply(event, fn); err != nil {
+		if err := s.apply(e, fn); err != nil {
 			return err
 		}
+		s.recordIdempotencyKey(e)
+		replayed++
 	}
-	return nil
+	return it.Err()
 }
 
 // Dispatch triggeres an event to be created
-func (s *Store) Dispatch(ctx context.Context, e *pb.Event) (*pb.Ack, error) {
+func (s *Store) Dispatch(ctx context.Context, e *pb.Event) (_ *pb.Ack, err error) {
+	ctx, span := trace.StartSpan(ctx, "store.Dispatch")
+	span.AddAttributes(eventAttributes(e)...)
+	defer func() { endSpan(span, err) }()
+	// Compress and encrypt aggregate data as configured
+	if e, err = encodeEvent(ctx, e); err != nil {
+		return nil, err
+	}
 	// Get gRPC client from service
 	c, ok := pluto.FromContext(ctx).Client(EventSourceCommandClientName)
 	if !ok {
@@ -109,11 +143,25 @@ func (s *Store) Dispatch(ctx context.Context, e *pb.Event) (*pb.Ack, error) {
 		return nil, err
 	}
 	defer conn.Close()
-	return c.Stub(conn).(pb.EventSourceCommandClient).Create(ctx, e)
+	start := time.Now()
+	ack, err := c.Stub(conn).(pb.EventSourceCommandClient).Create(ctx, e)
+	tags := map[tag.Key]string{KeySchema: e.Aggregate.GetSchema(), KeyTopic: e.GetTopic()}
+	recordMeasures(ctx, tags, MDispatchLatency.M(sinceInMilliseconds(start)))
+	if status.Code(err) == codes.Aborted {
+		recordMeasures(ctx, tags, MConcurrencyConflicts.M(1))
+	}
+	return ack, err
 }
 
 // Snapit triggeres an snapshot to be created
-func (s *Store) Snapit(ctx context.Context, e *pb.Event) (*pb.Ack, error) {
+func (s *Store) Snapit(ctx context.Context, e *pb.Event) (_ *pb.Ack, err error) {
+	ctx, span := trace.StartSpan(ctx, "store.Snapit")
+	span.AddAttributes(eventAttributes(e)...)
+	defer func() { endSpan(span, err) }()
+	// Compress and encrypt aggregate data as configured
+	if e, err = encodeEvent(ctx, e); err != nil {
+		return nil, err
+	}
 	// Get gRPC client from service
 	c, ok := pluto.FromContext(ctx).Client(EventSourceCommandClientName)
 	if !ok {
@@ -125,6 +173,11 @@ func (s *Store) Snapit(ctx context.Context, e *pb.Event) (*pb.Ack, error) {
 		return nil, err
 	}
 	defer conn.Close()
+	start := time.Now()
+	defer func() {
+		recordMeasures(ctx, map[tag.Key]string{KeySchema: e.Aggregate.GetSchema()},
+			MSnapshotLatency.M(sinceInMilliseconds(start)))
+	}()
 	return c.Stub(conn).(pb.EventSourceCommandClient).Snap(ctx, e)
 }
 
@@ -9,11 +9,71 @@ import (
 	"cloud.google.com/go/pubsub"
 	pb "github.com/aukbit/event-source-proto/es"
 	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// DefaultAckDeadline ack deadline of the subscriptions created
+const DefaultAckDeadline = 20 * time.Second
+
+const (
+	defaultReceiveRetryDelay   = 5 * time.Second
+	defaultReceiveStablePeriod = 30 * time.Second
+)
+
+// SubscribeOption is used to set options for Subscribe and CatchUpSubscribe
+type SubscribeOption func(*subscribeConfig)
+
+type subscribeConfig struct {
+	workers           int
+	retryDelay        time.Duration
+	stablePeriod      time.Duration
+	catchUpMaxBackoff time.Duration
+	catchUpLease      time.Duration
+}
+
+// ReceiveRetryDelay sets how long a subscription waits before receiving
+// messages again after failing to
+func ReceiveRetryDelay(d time.Duration) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.retryDelay = d
+	}
+}
+
+// ReceiveStablePeriod sets how long a subscription backing off must receive
+// messages without failing to be running again, if no message is received
+func ReceiveStablePeriod(d time.Duration) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.stablePeriod = d
+	}
+}
+
+func newSubscribeConfig(opts ...SubscribeOption) subscribeConfig {
+	c := subscribeConfig{
+		retryDelay:        defaultReceiveRetryDelay,
+		stablePeriod:      defaultReceiveStablePeriod,
+		catchUpMaxBackoff: defaultCatchUpMaxBackoff,
+		catchUpLease:      defaultCatchUpLease,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
 // GetOrCreateSubscription gets a reference or creates a Cloud PubSub subscription for the input topic
 func GetOrCreateSubscription(ctx context.Context, client *pubsub.Client, name string, topic *pubsub.Topic) (*pubsub.Subscription, error) {
+	return getOrCreateSubscription(ctx, client, name, topic, nil)
+}
+
+// getOrCreateSubscription is GetOrCreateSubscription creating the
+// subscription with extra labels. A subscription created meanwhile by
+// another replica is returned as available
+func getOrCreateSubscription(ctx context.Context, client *pubsub.Client, name string, topic *pubsub.Topic, labels map[string]string) (*pubsub.Subscription, error) {
 	l := zerolog.Ctx(ctx)
 	// Verify if topic exists
 	s := client.Subscription(name)
@@ -23,16 +83,23 @@ func GetOrCreateSubscription(ctx context.Context, client *pubsub.Client, name st
 	}
 	if !ok {
 		// [START create_subscription]
-		s, err = client.CreateSubscription(ctx, name, pubsub.SubscriptionConfig{
+		sl := map[string]string{"env": os.Getenv("GCP_PROJECT_ENV")}
+		for k, v := range labels {
+			sl[k] = v
+		}
+		created, err := client.CreateSubscription(ctx, name, pubsub.SubscriptionConfig{
 			Topic:       topic,
-			AckDeadline: 20 * time.Second,
-			Labels:      map[string]string{"env": os.Getenv("GCP_PROJECT_ENV")},
+			AckDeadline: DefaultAckDeadline,
+			Labels:      sl,
 		})
-		if err != nil {
+		switch {
+		case status.Code(err) == codes.AlreadyExists:
+		case err != nil:
 			return nil, err
+		default:
+			l.Info().Msgf("created subscription: %v", created)
+			return created, nil
 		}
-		l.Info().Msgf("created subscription: %v", s)
-		return s, nil
 	}
 	// [END create_subscription]
 	l.Info().Msgf("available subscription: %v", s)
@@ -52,42 +119,107 @@ func DeleteSubscription(ctx context.Context, client *pubsub.Client, name string)
 	return nil
 }
 
-func pullMsgsFromSubscription(ctx context.Context, sub *pubsub.Subscription, actions []Action) {
+// pullMsgsFromSubscription runs the actions for every message received on the
+// subscription. Events for which skip returns true are acked without running
+// the actions, skip may be nil. If sem is not nil actions only run once it
+// grants a slot to the event priority
+func pullMsgsFromSubscription(ctx context.Context, sub *pubsub.Subscription, actions []Action, skip func(*pb.Event) bool, cfg subscribeConfig, sem *prioritySemaphore) {
 	l := zerolog.Ctx(ctx)
-	if ok, err := sub.Exists(ctx); !ok {
+	h := DefaultSubscriptionHealth
+	ok, err := sub.Exists(ctx)
+	if err == nil && !ok {
+		err = errors.Wrap(errSubscriptionNotFound, sub.ID())
+	}
+	if err != nil {
 		l.Error().Msg(err.Error())
+		h.Stopped(sub.ID(), err)
 		return
 	}
 	// [START pull_messages]
 	cctx, _ := context.WithCancel(ctx)
+	h.Running(sub.ID())
 	for {
+		// after a failure the subscription is only running again once a
+		// message is received or Receive has not failed for a while, so the
+		// time it started backing off is kept while it keeps failing
+		recovered := time.AfterFunc(cfg.stablePeriod, func() { h.Running(sub.ID()) })
 		err := sub.Receive(cctx, func(ctx context.Context, msg *pubsub.Message) {
+			h.Received(sub.ID())
+			h.Running(sub.ID())
+			recordMeasures(ctx, map[tag.Key]string{KeySubscription: sub.ID()}, MMessagesReceived.M(1))
 			e := &pb.Event{}
 			err := proto.Unmarshal(msg.Data, e)
 			if err != nil {
 				// error parsing the message
 				l.Error().Msg(err.Error())
+				recordMeasures(ctx, map[tag.Key]string{KeySubscription: sub.ID()}, MMessagesNacked.M(1))
 				msg.Nack()
 				return
 			}
+			tags := map[tag.Key]string{KeySubscription: sub.ID(), KeySchema: e.Aggregate.GetSchema(), KeyTopic: e.GetTopic()}
 			// update context with eid
 			ctx = updateContext(ctx, e.Metadata["eid"])
-			l = zerolog.Ctx(ctx)
+			// continue the trace started by the producer of the event
+			ctx, span := startSpanFromEvent(ctx, "store.Receive", e)
+			defer span.End()
+			span.AddAttributes(trace.StringAttribute("subscription", sub.ID()))
+			span.AddAttributes(eventAttributes(e)...)
+			l := zerolog.Ctx(ctx)
 			l.Info().Msgf("message %v received on subscription: %v", msg.ID, sub)
-			for _, a := range actions {
-				if err := a(ctx, e); err != nil {
+			if skip != nil && skip(e) {
+				l.Info().Msgf("message %v already processed on subscription: %v", msg.ID, sub)
+				recordMeasures(ctx, tags, MMessagesAcked.M(1))
+				msg.Ack()
+				return
+			}
+			if sem != nil {
+				if err := sem.acquire(ctx, e.GetPriority()); err != nil {
 					l.Error().Msg(err.Error())
+					recordMeasures(ctx, tags, MMessagesNacked.M(1))
 					msg.Nack()
 					return
 				}
+				defer sem.release()
+			}
+			if err := runActions(ctx, e, actions, tags); err != nil {
+				l.Error().Msg(err.Error())
+				recordMeasures(ctx, tags, MMessagesNacked.M(1))
+				msg.Nack()
+				return
 			}
+			recordMeasures(ctx, tags, MMessagesAcked.M(1))
 			msg.Ack()
 		})
+		recovered.Stop()
+		if ctx.Err() != nil {
+			// the service is stopping
+			h.Stopped(sub.ID(), ctx.Err())
+			return
+		}
 		if err != nil {
 			// if pubsub is down or network issues - wait and try again
 			l.Error().Msg(err.Error())
-			time.Sleep(5 * time.Second)
+			h.BackingOff(sub.ID(), err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(cfg.retryDelay):
+			}
 		}
 	}
 	// [END pull_messages]
 }
+
+// runActions runs every action for the event, stopping at the first error
+func runActions(ctx context.Context, e *pb.Event, actions []Action, tags map[tag.Key]string) error {
+	for _, a := range actions {
+		start := time.Now()
+		actx, span := trace.StartSpan(ctx, "store.Action")
+		err := a(actx, e)
+		endSpan(span, err)
+		recordMeasures(ctx, tags, MActionLatency.M(sinceInMilliseconds(start)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
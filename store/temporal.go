@@ -0,0 +1,58 @@
+package store
+
+import (
+	"time"
+
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// LoadAsOf loads the aggregate state as it was at time t, starting from the
+// newest valid snapshot created before t and replaying events up to the last
+// one created at or before t
+func (s *Store) LoadAsOf(ctx context.Context, id string, t time.Time, fn ApplyFn) error {
+	if _, err := s.loadSnapshot(ctx, id, t); err != nil {
+		return err
+	}
+	it, err := NewEventIterator(ctx, EventQuery{
+		AggregateID:    id,
+		LowestVersion:  s.LowestVersion,
+		HighestVersion: s.HighestVersion,
+		CreatedTo:      t,
+	})
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	vc := s.newVersionChecker(ctx, id)
+	for it.Next() {
+		// events are listed by version, so the first one created after t
+		// means there is nothing else to apply
+		if !createdAtOrBefore(it.Event(), t) {
+			break
+		}
+		e := it.Event()
+		if err := vc.check(ctx, e); err != nil {
+			return err
+		}
+		if err := s.apply(e, fn); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// createdAtOrBefore reports if the event was created at or before t, a zero
+// t meaning any time. Events without a valid creation time are not
+func createdAtOrBefore(e *pb.Event, t time.Time) bool {
+	if t.IsZero() {
+		return true
+	}
+	created, err := ptypes.Timestamp(e.GetCreated())
+	if err != nil {
+		return false
+	}
+	return !created.After(t)
+}
@@ -0,0 +1,73 @@
+package store_test
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/aukbit/pluto-event-source/storetest"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// eventAt returns an event created at t
+func eventAt(t time.Time) *pb.Event {
+	e := storetest.Event("counted", &pb.Aggregate{})
+	e.Created, _ = ptypes.TimestampProto(t)
+	return e
+}
+
+func TestLoadAsOf(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	h.Append("1", eventAt(start), eventAt(start.Add(time.Minute)), eventAt(start.Add(2*time.Minute)))
+	c := &counter{}
+	for _, tc := range []struct {
+		at   time.Time
+		want int64
+	}{
+		{start.Add(-time.Second), 0},
+		{start, 1},
+		{start.Add(time.Minute + time.Second), 2},
+		{start.Add(time.Hour), 3},
+	} {
+		s := store.NewStore(&pb.Aggregate{})
+		if err := s.LoadAsOf(h.Context(), "1", tc.at, c.apply); err != nil {
+			t.Fatal(err)
+		}
+		if s.Version != tc.want {
+			t.Fatalf("as of %v: expected version %d got %d", tc.at, tc.want, s.Version)
+		}
+	}
+}
+
+func TestLoadAsOfSnapshot(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	h.Append("1", eventAt(start), eventAt(start.Add(time.Minute)))
+	c := &counter{}
+	// the snapshot is created now, after the events
+	snapshotAt(t, h, "1", 0, c)
+	h.Append("1", eventAt(time.Now().Add(time.Hour)))
+	for _, tc := range []struct {
+		name    string
+		at      time.Time
+		version int64
+		applied int
+	}{
+		{"before the snapshot", start.Add(time.Minute), 2, 2},
+		{"after the snapshot", time.Now().Add(time.Minute), 2, 0},
+		{"after the last event", time.Now().Add(2 * time.Hour), 3, 1},
+	} {
+		c.applied = 0
+		s := store.NewStore(&pb.Aggregate{})
+		if err := s.LoadAsOf(h.Context(), "1", tc.at, c.apply); err != nil {
+			t.Fatal(err)
+		}
+		if s.Version != tc.version || c.applied != tc.applied {
+			t.Fatalf("%s: expected version %d with %d events applied got %d with %d", tc.name, tc.version, tc.applied, s.Version, c.applied)
+		}
+	}
+}
@@ -14,6 +14,18 @@ var (
 	errGcpProjectEnvironmentNotDefined = errors.New("GCP_PROJECT_ENV not defined")
 )
 
+// TopicName returns the Cloud PubSub topic name of an event topic in the
+// environment eg. development.event_created
+func TopicName(env, topic string) string {
+	return fmt.Sprintf("%s.%s", env, strings.ToLower(topic))
+}
+
+// SubscriptionName returns the Cloud PubSub subscription name of a service
+// to an event topic in the environment eg. development.billing.event_created
+func SubscriptionName(env, service, topic string) string {
+	return fmt.Sprintf("%s.%s.%s", env, service, strings.ToLower(topic))
+}
+
 // GetOrCreateTopic create a Cloud PubSub topic if not exists
 func GetOrCreateTopic(ctx context.Context, client *pubsub.Client, topic string) (*pubsub.Topic, error) {
 	// Set project environment as topic prefix eg. development.event_created
@@ -21,7 +33,7 @@ func GetOrCreateTopic(ctx context.Context, client *pubsub.Client, topic string)
 	if !ok {
 		return nil, errGcpProjectEnvironmentNotDefined
 	}
-	name := fmt.Sprintf("%s.%s", env, strings.ToLower(topic))
+	name := TopicName(env, topic)
 	// Verify if topic exists
 	t := client.Topic(name)
 	ok, err := t.Exists(ctx)
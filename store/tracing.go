@@ -0,0 +1,141 @@
+package store
+
+import (
+	"encoding/base64"
+	"io"
+	"sync"
+	"time"
+
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"go.opencensus.io/plugin/ocgrpc"
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// TraceMetadataKey constant to be used as the key in Event Metadata holding
+	// the binary span context, base64 encoded, of the span that created the event
+	TraceMetadataKey string = "trace"
+)
+
+// endSpan sets the span status from err and ends the span
+func endSpan(span *trace.Span, err error) {
+	if err != nil {
+		st := status.Convert(err)
+		span.SetStatus(trace.Status{Code: int32(st.Code()), Message: st.Message()})
+	}
+	span.End()
+}
+
+// traceToMetadata adds the span context in ctx to the event metadata so the
+// trace can be continued by subscribers
+func traceToMetadata(ctx context.Context, e *pb.Event) {
+	span := trace.FromContext(ctx)
+	if span == nil {
+		return
+	}
+	if e.Metadata == nil {
+		e.Metadata = make(map[string]string)
+	}
+	e.Metadata[TraceMetadataKey] = base64.StdEncoding.EncodeToString(propagation.Binary(span.SpanContext()))
+}
+
+// startSpanFromEvent starts a span continuing the trace propagated in the
+// event metadata, if any
+func startSpanFromEvent(ctx context.Context, name string, e *pb.Event) (context.Context, *trace.Span) {
+	if v, ok := e.GetMetadata()[TraceMetadataKey]; ok {
+		if b, err := base64.StdEncoding.DecodeString(v); err == nil {
+			if sc, ok := propagation.FromBinary(b); ok {
+				return trace.StartSpanWithRemoteParent(ctx, name, sc, trace.WithSpanKind(trace.SpanKindServer))
+			}
+		}
+	}
+	return trace.StartSpan(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+}
+
+// eventAttributes returns the span attributes describing the event
+func eventAttributes(e *pb.Event) []trace.Attribute {
+	return []trace.Attribute{
+		trace.StringAttribute("topic", e.GetTopic()),
+		trace.StringAttribute("aggregate_id", e.GetAggregate().GetId()),
+		trace.StringAttribute("aggregate_schema", e.GetAggregate().GetSchema()),
+		trace.Int64Attribute("aggregate_version", e.GetAggregate().GetVersion()),
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// pluto clients do not accept dial options, so the ocgrpc client handler is
+// driven from interceptors instead of being installed as a grpc stats handler
+
+func ocgrpcUnaryClientInterceptor(h stats.Handler) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		begin := time.Now()
+		ctx = h.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: method})
+		h.HandleRPC(ctx, &stats.Begin{Client: true, BeginTime: begin})
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		h.HandleRPC(ctx, &stats.End{Client: true, BeginTime: begin, EndTime: time.Now(), Error: err})
+		return err
+	}
+}
+
+func ocgrpcStreamClientInterceptor(h stats.Handler) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		begin := time.Now()
+		ctx = h.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: method})
+		h.HandleRPC(ctx, &stats.Begin{Client: true, BeginTime: begin})
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			h.HandleRPC(ctx, &stats.End{Client: true, BeginTime: begin, EndTime: time.Now(), Error: err})
+			return nil, err
+		}
+		s := &tracedClientStream{ClientStream: cs, done: make(chan struct{}), end: func(err error) {
+			h.HandleRPC(ctx, &stats.End{Client: true, BeginTime: begin, EndTime: time.Now(), Error: err})
+		}}
+		// streams closed before being exhausted, e.g. by EventIterator.Close,
+		// end when their context is cancelled
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.finish(status.FromContextError(ctx.Err()).Err())
+			case <-s.done:
+			}
+		}()
+		return s, nil
+	}
+}
+
+// tracedClientStream reports the end of the RPC once the stream is exhausted,
+// fails or its context is done
+type tracedClientStream struct {
+	grpc.ClientStream
+	once sync.Once
+	done chan struct{}
+	end  func(error)
+}
+
+func (s *tracedClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == io.EOF {
+		s.finish(nil)
+	} else if err != nil {
+		s.finish(err)
+	}
+	return err
+}
+
+// finish reports the end of the RPC once
+func (s *tracedClientStream) finish(err error) {
+	s.once.Do(func() {
+		s.end(err)
+		close(s.done)
+	})
+}
+
+// defaultClientHandler is the ocgrpc handler used by the event source clients
+var defaultClientHandler = &ocgrpc.ClientHandler{}
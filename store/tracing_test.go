@@ -0,0 +1,129 @@
+package store
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	context "golang.org/x/net/context"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+func TestTraceMetadataRoundTrip(t *testing.T) {
+	ctx, parent := trace.StartSpan(context.Background(), "dispatch")
+	defer parent.End()
+	e := &pb.Event{Topic: "counted"}
+	traceToMetadata(ctx, e)
+	if e.Metadata[TraceMetadataKey] == "" {
+		t.Fatal("expected span context in event metadata")
+	}
+	_, child := startSpanFromEvent(context.Background(), "handle", e)
+	defer child.End()
+	if got, want := child.SpanContext().TraceID, parent.SpanContext().TraceID; got != want {
+		t.Fatalf("expected trace %v continued got %v", want, got)
+	}
+	if child.SpanContext().SpanID == parent.SpanContext().SpanID {
+		t.Fatal("expected a new span")
+	}
+	_, root := startSpanFromEvent(context.Background(), "handle", &pb.Event{})
+	defer root.End()
+	if root.SpanContext().TraceID == parent.SpanContext().TraceID {
+		t.Fatal("expected a new trace for events without span context")
+	}
+}
+
+// endRecorder records the End stats reported
+type endRecorder struct {
+	mu   sync.Mutex
+	ends []*stats.End
+}
+
+func (r *endRecorder) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context { return ctx }
+func (r *endRecorder) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+func (r *endRecorder) HandleConn(context.Context, stats.ConnStats) {}
+
+func (r *endRecorder) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	if end, ok := s.(*stats.End); ok {
+		r.mu.Lock()
+		r.ends = append(r.ends, end)
+		r.mu.Unlock()
+	}
+}
+
+func (r *endRecorder) Ends() []*stats.End {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*stats.End(nil), r.ends...)
+}
+
+// fakeClientStream returns the errors in order from RecvMsg
+type fakeClientStream struct {
+	grpc.ClientStream
+	errs []error
+}
+
+func (s *fakeClientStream) RecvMsg(m interface{}) error {
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	return err
+}
+
+func tracedStream(ctx context.Context, t *testing.T, r *endRecorder, errs ...error) grpc.ClientStream {
+	streamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return &fakeClientStream{errs: errs}, nil
+	}
+	cs, err := ocgrpcStreamClientInterceptor(r)(ctx, &grpc.StreamDesc{}, nil, "/es.EventSourceProjection/List", streamer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cs
+}
+
+func waitEnds(t *testing.T, r *endRecorder, n int) []*stats.End {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.Ends()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d ends got %d", n, len(r.Ends()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return r.Ends()
+}
+
+func TestTracedClientStreamEnd(t *testing.T) {
+	// exhausted
+	r := &endRecorder{}
+	cs := tracedStream(context.Background(), t, r, nil, io.EOF, io.EOF)
+	for cs.RecvMsg(nil) == nil {
+	}
+	cs.RecvMsg(nil)
+	if ends := waitEnds(t, r, 1); len(ends) != 1 || ends[0].Error != nil {
+		t.Fatalf("expected stream exhausted to end once without error got %v", ends)
+	}
+	// closed before being exhausted
+	r = &endRecorder{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cs = tracedStream(ctx, t, r, nil, nil)
+	if err := cs.RecvMsg(nil); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	ends := waitEnds(t, r, 1)
+	if status.Code(ends[0].Error) != codes.Canceled {
+		t.Fatalf("expected stream cancelled to end with %v got %v", codes.Canceled, ends[0].Error)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := len(r.Ends()); n != 1 {
+		t.Fatalf("expected stream to end once got %d", n)
+	}
+}
@@ -3,6 +3,8 @@ package store
 import (
 	"fmt"
 
+	context "golang.org/x/net/context"
+
 	"github.com/pkg/errors"
 
 	pb "github.com/aukbit/event-source-proto/es"
@@ -13,8 +15,20 @@ var (
 	errFormatNotSupported = errors.New("format not supported")
 )
 
-// UnmarshalEventData gets the unserialized data from the event
+// UnmarshalEventData gets the unserialized data from the event, decrypting and
+// decompressing it if needed. The data of redacted events is unmarshalled as empty.
+// Use UnmarshalEventDataContext to pass the caller context to the key store
 func UnmarshalEventData(e *pb.Event, out interface{}) error {
+	return UnmarshalEventDataContext(context.Background(), e, out)
+}
+
+// UnmarshalEventDataContext is UnmarshalEventData with the context used to
+// get the data key of encrypted events, so its deadline and trace apply
+func UnmarshalEventDataContext(ctx context.Context, e *pb.Event, out interface{}) error {
+	e, err := decodeEvent(ctx, e)
+	if err != nil {
+		return err
+	}
 	switch e.Aggregate.Format {
 	case pb.Aggregate_PROTOBUF:
 		err := proto.Unmarshal(e.Aggregate.Data, out.(proto.Message))
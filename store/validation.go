@@ -0,0 +1,181 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+)
+
+// PreconditionViolationType type of the precondition failure violations
+// returned for the aggregate state not accepting a command
+const PreconditionViolationType = "AGGREGATE_STATE"
+
+// CommandValidate validates a command against the current aggregate state, to
+// be used in AggregateCommand. The context gives access to the caller, e.g.
+// FromContextAny, and the clock
+type CommandValidate func(ctx context.Context, s *Store, cmd proto.Message) error
+
+// Validator is implemented by Validate and CommandValidate
+type Validator interface {
+	Check(ctx context.Context, s *Store, cmd proto.Message) error
+}
+
+// Check calls v(s)
+func (v Validate) Check(ctx context.Context, s *Store, cmd proto.Message) error {
+	return v(s)
+}
+
+// Check calls v(ctx, s, cmd)
+func (v CommandValidate) Check(ctx context.Context, s *Store, cmd proto.Message) error {
+	return v(ctx, s, cmd)
+}
+
+// -----------------------------------------------------------------------------
+
+// Violation describes why a command is not valid
+type Violation struct {
+	// Field of the command, or subject of the precondition, violated
+	Field       string
+	Description string
+	// Precondition is true if the command is well formed but the aggregate
+	// is not in a state to accept it
+	Precondition bool
+}
+
+// ValidationError holds all the violations found by the validations of a
+// command. It is converted to a grpc status with code FailedPrecondition if
+// any violation is a precondition, InvalidArgument otherwise, and the
+// violations as errdetails.BadRequest and errdetails.PreconditionFailure details
+type ValidationError struct {
+	Violations []Violation
+}
+
+// InvalidArgument returns a validation error for an invalid command field
+func InvalidArgument(field, description string) error {
+	return &ValidationError{Violations: []Violation{{Field: field, Description: description}}}
+}
+
+// FailedPrecondition returns a validation error for a precondition the
+// aggregate state does not meet
+func FailedPrecondition(subject, description string) error {
+	return &ValidationError{Violations: []Violation{{Field: subject, Description: description, Precondition: true}}}
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = fmt.Sprintf("%s: %s", v.Field, v.Description)
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+// Code returns the grpc code of the error
+func (e *ValidationError) Code() codes.Code {
+	for _, v := range e.Violations {
+		if v.Precondition {
+			return codes.FailedPrecondition
+		}
+	}
+	return codes.InvalidArgument
+}
+
+// GRPCStatus returns the grpc status of the error with the field violations
+// as a errdetails.BadRequest detail and the preconditions violated as a
+// errdetails.PreconditionFailure detail
+func (e *ValidationError) GRPCStatus() *status.Status {
+	st := status.New(e.Code(), e.Error())
+	br := &errdetails.BadRequest{}
+	pf := &errdetails.PreconditionFailure{}
+	for _, v := range e.Violations {
+		if v.Precondition {
+			pf.Violations = append(pf.Violations, &errdetails.PreconditionFailure_Violation{
+				Type:        PreconditionViolationType,
+				Subject:     v.Field,
+				Description: v.Description,
+			})
+			continue
+		}
+		br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       v.Field,
+			Description: v.Description,
+		})
+	}
+	var details []proto.Message
+	if len(br.FieldViolations) > 0 {
+		details = append(details, br)
+	}
+	if len(pf.Violations) > 0 {
+		details = append(details, pf)
+	}
+	if ds, err := st.WithDetails(details...); err == nil {
+		return ds
+	}
+	return st
+}
+
+// ValidationErrorFromStatus returns the validation error described by a grpc
+// status returned by a command service
+func ValidationErrorFromStatus(st *status.Status) (*ValidationError, bool) {
+	if st.Code() != codes.InvalidArgument && st.Code() != codes.FailedPrecondition {
+		return nil, false
+	}
+	e := &ValidationError{}
+	for _, d := range st.Details() {
+		switch d := d.(type) {
+		case *errdetails.BadRequest:
+			for _, v := range d.GetFieldViolations() {
+				e.Violations = append(e.Violations, Violation{Field: v.GetField(), Description: v.GetDescription()})
+			}
+		case *errdetails.PreconditionFailure:
+			for _, v := range d.GetViolations() {
+				e.Violations = append(e.Violations, Violation{Field: v.GetSubject(), Description: v.GetDescription(), Precondition: true})
+			}
+		}
+	}
+	return e, len(e.Violations) > 0
+}
+
+// validate runs every validation collecting the violations found. Errors other
+// than *ValidationError are returned straight away
+func validate(ctx context.Context, s *Store, cmd proto.Message, validations []Validator) error {
+	verr := &ValidationError{}
+	for _, v := range validations {
+		err := v.Check(ctx, s, cmd)
+		if err == nil {
+			continue
+		}
+		e, ok := err.(*ValidationError)
+		if !ok {
+			return err
+		}
+		verr.Violations = append(verr.Violations, e.Violations...)
+	}
+	if len(verr.Violations) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+type clockContextKey struct{}
+
+// WithClock returns a copy of parent ctx in which Now uses the clock
+func WithClock(ctx context.Context, clock func() time.Time) context.Context {
+	return context.WithValue(ctx, clockContextKey{}, clock)
+}
+
+// Now returns the current time from the clock in ctx, if any, or time.Now
+func Now(ctx context.Context) time.Time {
+	if clock, ok := ctx.Value(clockContextKey{}).(func() time.Time); ok {
+		return clock()
+	}
+	return time.Now()
+}
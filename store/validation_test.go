@@ -0,0 +1,98 @@
+package store_test
+
+import (
+	"testing"
+	"time"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/aukbit/pluto-event-source/storetest"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestAggregateValidations(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	c := &counter{}
+	validations := []store.Validate{
+		func(s *store.Store) error { return store.InvalidArgument("id", "required") },
+		func(s *store.Store) error { return store.FailedPrecondition("version", "aggregate closed") },
+	}
+	h.Given("1").
+		When(&pb.Aggregate{}, c.apply, "counted", &pb.Aggregate{}, validations...).
+		ThenError(codes.FailedPrecondition).
+		ThenNoEvents()
+	h.Given("1").
+		When(&pb.Aggregate{}, c.apply, "counted", &pb.Aggregate{}, validations[0]).
+		ThenError(codes.InvalidArgument)
+	h.Given("1").
+		When(&pb.Aggregate{}, c.apply, "counted", &pb.Aggregate{}).
+		ThenNoError().
+		ThenEvents(storetest.Event("counted", &pb.Aggregate{}))
+}
+
+func TestAggregateCommandValidations(t *testing.T) {
+	h := storetest.New(t)
+	defer h.Close()
+	c := &counter{}
+	closed := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	open := func(ctx context.Context, s *store.Store, cmd proto.Message) error {
+		if store.Now(ctx).After(closed) {
+			return store.FailedPrecondition("time", "closed")
+		}
+		if cmd.(*pb.Aggregate).GetId() == "" {
+			return store.InvalidArgument("id", "required")
+		}
+		return nil
+	}
+	h.Given("1").
+		WhenCommand(&pb.Aggregate{}, c.apply, "counted", &pb.Aggregate{Id: "1"}, open).
+		ThenError(codes.FailedPrecondition)
+	ctx := store.WithClock(h.Context(), func() time.Time { return closed.Add(-time.Hour) })
+	if _, err := store.AggregateCommand(ctx, &pb.Aggregate{}, "1", &pb.Aggregate{}, "counted", nil, c.apply, open); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected %v got %v", codes.InvalidArgument, err)
+	}
+	if _, err := store.AggregateCommand(ctx, &pb.Aggregate{}, "1", &pb.Aggregate{Id: "1"}, "counted", nil, c.apply, open); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidationErrorStatus(t *testing.T) {
+	verr := &store.ValidationError{Violations: []store.Violation{
+		{Field: "amount", Description: "must be positive"},
+		{Field: "order", Description: "already paid", Precondition: true},
+	}}
+	// as received by a client
+	st := status.FromProto(status.Convert(verr).Proto())
+	if st.Code() != codes.FailedPrecondition {
+		t.Fatalf("expected %v got %v", codes.FailedPrecondition, st.Code())
+	}
+	var br *errdetails.BadRequest
+	var pf *errdetails.PreconditionFailure
+	for _, d := range st.Details() {
+		switch d := d.(type) {
+		case *errdetails.BadRequest:
+			br = d
+		case *errdetails.PreconditionFailure:
+			pf = d
+		}
+	}
+	if len(br.GetFieldViolations()) != 1 || br.FieldViolations[0].GetField() != "amount" {
+		t.Fatalf("expected bad request detail with the field violation got %v", br)
+	}
+	if len(pf.GetViolations()) != 1 || pf.Violations[0].GetSubject() != "order" || pf.Violations[0].GetType() != store.PreconditionViolationType {
+		t.Fatalf("expected precondition failure detail with the violation got %v", pf)
+	}
+	got, ok := store.ValidationErrorFromStatus(st)
+	if !ok {
+		t.Fatal("expected validation error from status")
+	}
+	if len(got.Violations) != 2 || got.Violations[0] != verr.Violations[0] || got.Violations[1] != verr.Violations[1] {
+		t.Fatalf("expected violations %v got %v", verr.Violations, got.Violations)
+	}
+}
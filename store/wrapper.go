@@ -2,6 +2,7 @@ package store
 
 import (
 	"errors"
+	"time"
 
 	context "golang.org/x/net/context"
 	"google.golang.org/grpc"
@@ -9,6 +10,8 @@ import (
 	pb "github.com/aukbit/event-source-proto/es"
 	plutoClt "github.com/aukbit/pluto/client"
 	"github.com/golang/protobuf/proto"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 )
 
 var (
@@ -47,12 +50,14 @@ func ActionWrapper(aggregator interface{}, aFn ApplyFn, hFn ...HookFn) Action {
 		// NOTE: we will apply the changes of the event here. We may want to compare the
 		// previous state with the new event and apply diffrent rules.
 		// To be able to do this we aggregate all events up to the previous version of the current event
-		s.LowestVersion = 1
 		s.HighestVersion = e.Aggregate.GetVersion() - 1
 
-		// Load store
-		if err := s.LoadEvents(ctx, id, aFn); err != nil {
-			return err
+		// Load store from the latest snapshot, there is nothing to load before
+		// the first event
+		if s.HighestVersion > 0 {
+			if err := s.Load(ctx, id, aFn); err != nil {
+				return err
+			}
 		}
 
 		// Create a copy of the state
@@ -65,8 +70,14 @@ func ActionWrapper(aggregator interface{}, aFn ApplyFn, hFn ...HookFn) Action {
 		}
 
 		// Run hook functions
+		tags := map[tag.Key]string{KeySchema: e.Aggregate.GetSchema(), KeyTopic: e.GetTopic()}
 		for _, f := range hFn {
-			err := f(ctx, e, prevState, nextState)
+			start := time.Now()
+			hctx, span := trace.StartSpan(ctx, "store.HookFn")
+			span.AddAttributes(eventAttributes(e)...)
+			err := f(hctx, e, prevState, nextState)
+			endSpan(span, err)
+			recordMeasures(ctx, tags, MHookLatency.M(sinceInMilliseconds(start)))
 			if err != nil {
 				return err
 			}
@@ -80,6 +91,16 @@ func ActionWrapper(aggregator interface{}, aFn ApplyFn, hFn ...HookFn) Action {
 // SnapshotActionWrapper loads an agregator current state. Takes a snapshot every
 // number events (nEvents)
 func SnapshotActionWrapper(aggregator proto.Message, aFn ApplyFn, nEvents int64) Action {
+	return SnapshotPolicyActionWrapper(aggregator, aFn, VersionModulo(nEvents))
+}
+
+// SnapshotPolicyActionWrapper takes a snapshot of the agregator whenever the
+// policy is satisfied. For policies requiring the last snapshot, it is read
+// from the event store the first time the aggregate is seen. Policies
+// requiring state keep the state of the most recently used aggregates, so
+// only the events appended since are loaded
+func SnapshotPolicyActionWrapper(aggregator proto.Message, aFn ApplyFn, policy SnapshotPolicy) Action {
+	tracker := newSnapshotTracker(defaultSnapshotTrackerSize)
 	return func(ctx context.Context, e *pb.Event) error {
 
 		// Verify event aggregate
@@ -95,13 +116,26 @@ func SnapshotActionWrapper(aggregator proto.Message, aFn ApplyFn, nEvents int64)
 			return ErrInvalidVersion
 		}
 
-		if !IsSnapshotTime(e, nEvents) {
+		info, s, err := snapshotInfo(ctx, tracker, policy, e, aggregator, aFn)
+		if err != nil {
+			return err
+		}
+
+		if !policy.ShouldSnapshot(info) {
 			return nil
 		}
 
-		if err := TakeSnapshot(ctx, e, aggregator, aFn); err != nil {
+		// Load aggregator if not loaded yet by the policy
+		if s == nil {
+			if s, err = loadSnapshotState(ctx, e, aggregator, aFn); err != nil {
+				return err
+			}
+		}
+
+		if err := snapStore(ctx, e, s, aggregator); err != nil {
 			return err
 		}
+		tracker.snapped(e.Aggregate.GetId(), e.Aggregate.GetVersion())
 
 		return nil
 	}
@@ -115,6 +149,14 @@ func NewEventSourceQueryClient(target string) *plutoClt.Client {
 			return pb.NewEventSourceProjectionClient(cc)
 		}),
 		plutoClt.Target(target),
+		plutoClt.UnaryClientInterceptors([]grpc.UnaryClientInterceptor{
+			EventIDUnaryClientInterceptor(),
+			ocgrpcUnaryClientInterceptor(defaultClientHandler),
+		}),
+		plutoClt.StreamClientInterceptors([]grpc.StreamClientInterceptor{
+			EventIDStreamClientInterceptor(),
+			ocgrpcStreamClientInterceptor(defaultClientHandler),
+		}),
 	)
 }
 
@@ -126,5 +168,13 @@ func NewEventSourceCommandClient(target string) *plutoClt.Client {
 			return pb.NewEventSourceCommandClient(cc)
 		}),
 		plutoClt.Target(target),
+		plutoClt.UnaryClientInterceptors([]grpc.UnaryClientInterceptor{
+			EventIDUnaryClientInterceptor(),
+			ocgrpcUnaryClientInterceptor(defaultClientHandler),
+		}),
+		plutoClt.StreamClientInterceptors([]grpc.StreamClientInterceptor{
+			EventIDStreamClientInterceptor(),
+			ocgrpcStreamClientInterceptor(defaultClientHandler),
+		}),
 	)
 }
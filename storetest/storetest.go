@@ -0,0 +1,289 @@
+// Package storetest runs aggregate specs against an in-process event store.
+//
+//	h := storetest.New(t)
+//	defer h.Close()
+//	h.Given(id, storetest.Event("order_created", created)).
+//		When(&orders.Order{}, apply, "order_paid", paid, validations...).
+//		ThenEvents(storetest.Event("order_paid", paid)).
+//		ThenState(want)
+package storetest
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto"
+	"github.com/aukbit/pluto-event-source/eventstore"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/golang/protobuf/proto"
+)
+
+// Harness runs an in-process event store and a pluto service holding the
+// event source clients connected to it
+type Harness struct {
+	t      testing.TB
+	es     *eventstore.Server
+	srv    *grpc.Server
+	target string
+	ctx    context.Context
+}
+
+// New starts a new harness, it must be closed at the end of the test
+func New(t testing.TB) *Harness {
+	t.Helper()
+	return NewWith(t, eventstore.NewMemory())
+}
+
+// NewWith starts a new harness serving the event store, eg. one built by
+// eventstore.New on logs holding events the store would not append
+func NewWith(t testing.TB, es *eventstore.Server) *Harness {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("storetest: %v", err)
+	}
+	srv := grpc.NewServer()
+	es.Register(srv)
+	go srv.Serve(lis)
+	h := &Harness{
+		t:      t,
+		es:     es,
+		srv:    srv,
+		target: lis.Addr().String(),
+	}
+	h.ctx = h.NewContext()
+	return h
+}
+
+// Context returns a context holding the pluto service, to call store functions
+func (h *Harness) Context() context.Context {
+	return h.ctx
+}
+
+// NewContext returns a context holding a new pluto service connected to the
+// event store, as another instance of the service. Pluto clients are not safe
+// for concurrent use, so goroutines running store functions concurrently
+// should each use their own context
+func (h *Harness) NewContext() context.Context {
+	s := pluto.New(
+		pluto.Name("storetest"),
+		pluto.Clients(store.NewEventSourceCommandClient(h.target)),
+		pluto.Clients(store.NewEventSourceQueryClient(h.target)),
+	)
+	return s.WithContext(context.Background())
+}
+
+// Target returns the address of the event store, to connect other clients
+// such as the es command line tool
+func (h *Harness) Target() string {
+	return h.target
+}
+
+// Close stops the event store
+func (h *Harness) Close() {
+	h.srv.Stop()
+}
+
+// Append appends events to the aggregate, after its current version
+func (h *Harness) Append(id string, events ...*pb.Event) {
+	h.t.Helper()
+	for _, e := range events {
+		e = proto.Clone(e).(*pb.Event)
+		if e.Aggregate == nil {
+			e.Aggregate = &pb.Aggregate{}
+		}
+		e.Aggregate.Id = id
+		e.Aggregate.Version = h.es.Version(id)
+		if _, err := h.es.Create(h.ctx, e); err != nil {
+			h.t.Fatalf("storetest: append %s to %s: %v", e.GetTopic(), id, err)
+		}
+	}
+}
+
+// Events returns the events of the aggregate in the event store
+func (h *Harness) Events(id string) []*pb.Event {
+	h.t.Helper()
+	events, err := h.es.Events(id)
+	if err != nil {
+		h.t.Fatalf("storetest: events of %s: %v", id, err)
+	}
+	return events
+}
+
+// Given starts a spec for the aggregate with the events already appended
+func (h *Harness) Given(id string, events ...*pb.Event) *Spec {
+	h.t.Helper()
+	h.Append(id, events...)
+	return &Spec{h: h, id: id, given: h.es.Version(id)}
+}
+
+// Event returns an event with the input message encoded as data
+func Event(topic string, in proto.Message) *pb.Event {
+	e, err := store.NewEvent(topic, in)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// -----------------------------------------------------------------------------
+
+// Spec holds the outcome of a command or an event run against an aggregate
+type Spec struct {
+	h     *Harness
+	id    string
+	given int64
+	store *store.Store
+	err   error
+}
+
+// When runs the command through Aggregate
+func (s *Spec) When(aggregator interface{}, apply store.ApplyFn, topic string, cmd proto.Message, validations ...store.Validate) *Spec {
+	s.store, s.err = store.Aggregate(s.h.ctx, aggregator, s.id, cmd, topic, nil, apply, validations...)
+	return s
+}
+
+// WhenCommand runs the command through AggregateCommand
+func (s *Spec) WhenCommand(aggregator interface{}, apply store.ApplyFn, topic string, cmd proto.Message, validations ...store.CommandValidate) *Spec {
+	s.store, s.err = store.AggregateCommand(s.h.ctx, aggregator, s.id, cmd, topic, nil, apply, validations...)
+	return s
+}
+
+// WhenEvent appends the event to the aggregate and runs the action with it,
+// as a subscription would when receiving it
+func (s *Spec) WhenEvent(action store.Action, e *pb.Event) *Spec {
+	s.h.t.Helper()
+	s.h.Append(s.id, e)
+	events := s.h.Events(s.id)
+	s.err = action(s.h.ctx, events[len(events)-1])
+	return s
+}
+
+// ThenEvents expects the events appended by When, compared by topic, schema
+// and data
+func (s *Spec) ThenEvents(events ...*pb.Event) *Spec {
+	s.h.t.Helper()
+	got := s.h.Events(s.id)[s.given:]
+	if len(got) != len(events) {
+		s.h.t.Errorf("storetest: %s expected %d events got %d: %v", s.id, len(events), len(got), topics(got))
+		return s
+	}
+	for i, e := range events {
+		if got[i].GetTopic() != e.GetTopic() ||
+			got[i].Aggregate.GetSchema() != e.GetAggregate().GetSchema() ||
+			!bytes.Equal(got[i].Aggregate.GetData(), e.GetAggregate().GetData()) {
+			s.h.t.Errorf("storetest: %s expected event %d %s %s got %s %s", s.id, i,
+				e.GetTopic(), e.GetAggregate().GetSchema(), got[i].GetTopic(), got[i].Aggregate.GetSchema())
+		}
+	}
+	return s
+}
+
+// ThenNoEvents expects no events appended by When
+func (s *Spec) ThenNoEvents() *Spec {
+	s.h.t.Helper()
+	return s.ThenEvents()
+}
+
+// ThenError expects an error with the grpc code, codes.OK meaning no error
+func (s *Spec) ThenError(code codes.Code) *Spec {
+	s.h.t.Helper()
+	if got := status.Code(s.err); got != code {
+		s.h.t.Errorf("storetest: %s expected %v got %v: %v", s.id, code, got, s.err)
+	}
+	return s
+}
+
+// ThenNoError expects no error
+func (s *Spec) ThenNoError() *Spec {
+	s.h.t.Helper()
+	if s.err != nil {
+		s.h.t.Errorf("storetest: %s unexpected error: %v", s.id, s.err)
+	}
+	return s
+}
+
+// ThenState expects the aggregate state returned by Aggregate
+func (s *Spec) ThenState(want proto.Message) *Spec {
+	s.h.t.Helper()
+	if s.store == nil {
+		s.h.t.Errorf("storetest: %s expected state %v got error %v", s.id, want, s.err)
+		return s
+	}
+	got, ok := s.store.State.(proto.Message)
+	if !ok || !proto.Equal(got, want) {
+		s.h.t.Errorf("storetest: %s expected state %v got %v", s.id, want, s.store.State)
+	}
+	return s
+}
+
+// ThenHookCalled expects the last call recorded by the hook recorder to be
+// with the previous and next states
+func (s *Spec) ThenHookCalled(r *HookRecorder, prev, next proto.Message) *Spec {
+	s.h.t.Helper()
+	calls := r.Calls()
+	if len(calls) == 0 {
+		s.h.t.Errorf("storetest: %s expected hook to be called", s.id)
+		return s
+	}
+	c := calls[len(calls)-1]
+	if !equalState(c.Prev, prev) {
+		s.h.t.Errorf("storetest: %s expected hook previous state %v got %v", s.id, prev, c.Prev)
+	}
+	if !equalState(c.Next, next) {
+		s.h.t.Errorf("storetest: %s expected hook next state %v got %v", s.id, next, c.Next)
+	}
+	return s
+}
+
+// -----------------------------------------------------------------------------
+
+// HookCall holds the arguments of a hook call
+type HookCall struct {
+	Event      *pb.Event
+	Prev, Next interface{}
+}
+
+// HookRecorder records the calls of its Hook, to be passed to ActionWrapper
+type HookRecorder struct {
+	mu    sync.Mutex
+	calls []HookCall
+	// Err is returned by Hook
+	Err error
+}
+
+// Hook records the call and returns r.Err
+func (r *HookRecorder) Hook(ctx context.Context, e *pb.Event, prevState, nextState interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, HookCall{Event: e, Prev: prevState, Next: nextState})
+	return r.Err
+}
+
+// Calls returns the calls recorded
+func (r *HookRecorder) Calls() []HookCall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]HookCall(nil), r.calls...)
+}
+
+func equalState(got interface{}, want proto.Message) bool {
+	m, ok := got.(proto.Message)
+	return ok && proto.Equal(m, want)
+}
+
+func topics(events []*pb.Event) []string {
+	out := make([]string, len(events))
+	for i, e := range events {
+		out[i] = e.GetTopic()
+	}
+	return out
+}
@@ -0,0 +1,108 @@
+package storetest
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+
+	pb "github.com/aukbit/event-source-proto/es"
+	"github.com/aukbit/pluto-event-source/store"
+	"github.com/golang/protobuf/proto"
+)
+
+// apply keeps the version and topic of the last event applied
+func apply(e *pb.Event, state interface{}) (interface{}, error) {
+	a := proto.Clone(state.(proto.Message)).(*pb.Aggregate)
+	a.Version = e.Aggregate.GetVersion()
+	a.Schema = e.GetTopic()
+	return a, nil
+}
+
+// recordingT records the errors reported by the harness instead of failing
+type recordingT struct {
+	testing.TB
+	errors []string
+}
+
+func (t *recordingT) Helper() {}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestHarnessAppend(t *testing.T) {
+	h := New(t)
+	defer h.Close()
+	h.Append("1", Event("created", &pb.Aggregate{}), Event("paid", &pb.Aggregate{}))
+	h.Append("2", Event("created", &pb.Aggregate{}))
+	h.Append("1", Event("shipped", &pb.Aggregate{}))
+	events := h.Events("1")
+	if got := topics(events); fmt.Sprint(got) != "[created paid shipped]" {
+		t.Fatalf("expected events appended in order got %v", got)
+	}
+	for i, e := range events {
+		if e.Aggregate.GetId() != "1" || e.Aggregate.GetVersion() != int64(i+1) {
+			t.Fatalf("expected event %d of 1 at version %d got %v", i, i+1, e.Aggregate)
+		}
+	}
+	// contexts of other instances share the event store
+	s := store.NewStore(&pb.Aggregate{})
+	if err := s.LoadEvents(h.NewContext(), "2", apply); err != nil {
+		t.Fatal(err)
+	}
+	if s.Version != 1 {
+		t.Fatalf("expected 2 at version 1 got %d", s.Version)
+	}
+}
+
+func TestSpec(t *testing.T) {
+	h := New(t)
+	defer h.Close()
+	h.Given("1", Event("created", &pb.Aggregate{})).
+		When(&pb.Aggregate{}, apply, "paid", &pb.Aggregate{Id: "p"}).
+		ThenNoError().
+		ThenEvents(Event("paid", &pb.Aggregate{Id: "p"})).
+		ThenState(&pb.Aggregate{Version: 1, Schema: "paid"})
+	closed := func(s *store.Store) error { return store.FailedPrecondition("state", "closed") }
+	h.Given("1").
+		When(&pb.Aggregate{}, apply, "paid", &pb.Aggregate{}, closed).
+		ThenError(codes.FailedPrecondition).
+		ThenNoEvents()
+}
+
+func TestSpecWhenEvent(t *testing.T) {
+	h := New(t)
+	defer h.Close()
+	r := &HookRecorder{}
+	action := store.ActionWrapper(&pb.Aggregate{}, apply, r.Hook)
+	h.Given("1", Event("created", &pb.Aggregate{})).
+		WhenEvent(action, Event("paid", &pb.Aggregate{})).
+		ThenNoError().
+		ThenHookCalled(r, &pb.Aggregate{Version: 1, Schema: "created"}, &pb.Aggregate{Version: 2, Schema: "paid"})
+	r.Err = errors.New("hook failed")
+	h.Given("1").
+		WhenEvent(action, Event("shipped", &pb.Aggregate{})).
+		ThenError(codes.Unknown)
+	if calls := r.Calls(); len(calls) != 2 || calls[1].Event.GetTopic() != "shipped" {
+		t.Fatalf("expected 2 hook calls got %d", len(calls))
+	}
+}
+
+func TestSpecFailures(t *testing.T) {
+	h := New(t)
+	defer h.Close()
+	rt := &recordingT{TB: t}
+	spec := h.Given("1", Event("created", &pb.Aggregate{}))
+	spec.h = &Harness{t: rt, es: h.es, ctx: h.ctx}
+	spec.When(&pb.Aggregate{}, apply, "paid", &pb.Aggregate{}).
+		ThenError(codes.InvalidArgument).
+		ThenEvents(Event("shipped", &pb.Aggregate{})).
+		ThenEvents().
+		ThenState(&pb.Aggregate{Version: 9}).
+		ThenHookCalled(&HookRecorder{}, &pb.Aggregate{}, &pb.Aggregate{})
+	if len(rt.errors) != 5 {
+		t.Fatalf("expected 5 failed expectations got %d: %v", len(rt.errors), rt.errors)
+	}
+}
@@ -0,0 +1,325 @@
+// Package topology manages the Cloud PubSub topics and subscriptions used by
+// the services of an environment. The topology declared in a manifest is
+// compared with the current one to plan the changes needed to converge, which
+// may include deleting orphaned subscriptions of services or topics removed.
+// It works against the PubSub emulator when PUBSUB_EMULATOR_HOST is set.
+package topology
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	context "golang.org/x/net/context"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/aukbit/pluto-event-source/store"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	deletedTopic = "_deleted-topic_"
+)
+
+// Manifest declares the event topics each service subscribes to
+type Manifest struct {
+	// Services maps a service name to its topics
+	Services map[string][]string `json:"services"`
+	// Topics published without subscribers
+	Topics []string `json:"topics,omitempty"`
+}
+
+// ReadManifest reads a manifest from a json file
+//
+//	{"services": {"billing": ["order_created", "order_paid"]}}
+func ReadManifest(path string) (*Manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := &Manifest{}
+	if err := json.NewDecoder(f).Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Add declares the topics subscribed by the service, as passed to Subscribe
+func (m *Manifest) Add(service string, topics store.Topics) {
+	if m.Services == nil {
+		m.Services = make(map[string][]string)
+	}
+	for t := range topics {
+		m.Services[service] = append(m.Services[service], t)
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// Topic holds the configuration of a topic
+type Topic struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Subscription holds the configuration of a subscription
+type Subscription struct {
+	Name string `json:"name"`
+	// Topic is empty if the topic has been deleted
+	Topic       string            `json:"topic"`
+	AckDeadline time.Duration     `json:"ack_deadline"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// State holds the topics and subscriptions of an environment
+type State struct {
+	Env           string         `json:"env"`
+	Topics        []Topic        `json:"topics"`
+	Subscriptions []Subscription `json:"subscriptions"`
+}
+
+// Current returns the topics and subscriptions named with the environment prefix
+func Current(ctx context.Context, client *pubsub.Client, env string) (*State, error) {
+	prefix := env + "."
+	st := &State{Env: env}
+	tit := client.Topics(ctx)
+	for {
+		t, err := tit.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(t.ID(), prefix) {
+			continue
+		}
+		cfg, err := t.Config(ctx)
+		if err != nil {
+			return nil, err
+		}
+		st.Topics = append(st.Topics, Topic{Name: t.ID(), Labels: cfg.Labels})
+	}
+	sit := client.Subscriptions(ctx)
+	for {
+		s, err := sit.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(s.ID(), prefix) {
+			continue
+		}
+		cfg, err := s.Config(ctx)
+		if err != nil {
+			return nil, err
+		}
+		sub := Subscription{Name: s.ID(), AckDeadline: cfg.AckDeadline, Labels: cfg.Labels}
+		if cfg.Topic != nil && cfg.Topic.String() != deletedTopic {
+			sub.Topic = cfg.Topic.ID()
+		}
+		st.Subscriptions = append(st.Subscriptions, sub)
+	}
+	sort.Slice(st.Topics, func(i, j int) bool { return st.Topics[i].Name < st.Topics[j].Name })
+	sort.Slice(st.Subscriptions, func(i, j int) bool { return st.Subscriptions[i].Name < st.Subscriptions[j].Name })
+	return st, nil
+}
+
+// -----------------------------------------------------------------------------
+
+// Action of a change
+type Action string
+
+// Actions
+const (
+	Create Action = "create"
+	Update Action = "update"
+	Delete Action = "delete"
+)
+
+// Change to the topology
+type Change struct {
+	Action Action `json:"action"`
+	// Topic is set for topic changes and subscriptions created
+	Topic string `json:"topic,omitempty"`
+	// Subscription is empty for topic changes
+	Subscription string `json:"subscription,omitempty"`
+	Reason       string `json:"reason"`
+}
+
+func (c Change) String() string {
+	if c.Subscription == "" {
+		return fmt.Sprintf("%s topic %s: %s", c.Action, c.Topic, c.Reason)
+	}
+	return fmt.Sprintf("%s subscription %s: %s", c.Action, c.Subscription, c.Reason)
+}
+
+// Plan returns the changes to converge the current state to the manifest.
+// Topics and subscriptions are created with the env label and subscriptions
+// with DefaultAckDeadline. Topics and subscriptions not declared, or
+// subscriptions to another topic, are only deleted if prune is true, as they
+// may still be used by services not declared
+func Plan(m *Manifest, st *State, prune bool) []Change {
+	var changes []Change
+	// declared topics and subscriptions
+	topics := make(map[string]string)
+	subs := make(map[string]string)
+	for _, t := range m.Topics {
+		topics[store.TopicName(st.Env, t)] = t
+	}
+	for service, ts := range m.Services {
+		for _, t := range ts {
+			topics[store.TopicName(st.Env, t)] = t
+			subs[store.SubscriptionName(st.Env, service, t)] = store.TopicName(st.Env, t)
+		}
+	}
+	// topics
+	current := make(map[string]bool)
+	for _, t := range st.Topics {
+		current[t.Name] = true
+		_, declared := topics[t.Name]
+		switch {
+		case !declared:
+			if prune {
+				changes = append(changes, Change{Action: Delete, Topic: t.Name, Reason: "not declared"})
+			}
+		case t.Labels["env"] != st.Env:
+			changes = append(changes, Change{Action: Update, Topic: t.Name, Reason: envLabel(t.Labels, st.Env)})
+		}
+	}
+	for _, name := range sortedKeys(topics) {
+		if !current[name] {
+			changes = append(changes, Change{Action: Create, Topic: name, Reason: "declared"})
+		}
+	}
+	// subscriptions
+	current = make(map[string]bool)
+	deleted := make(map[string]bool)
+	for _, s := range st.Subscriptions {
+		current[s.Name] = true
+		topic, ok := subs[s.Name]
+		var orphaned string
+		switch {
+		case !ok:
+			orphaned = "orphaned, not declared"
+		case s.Topic == "":
+			orphaned = "orphaned, topic deleted"
+		case s.Topic != topic:
+			orphaned = "subscribed to " + s.Topic
+		}
+		if orphaned != "" {
+			if prune {
+				changes = append(changes, Change{Action: Delete, Subscription: s.Name, Reason: orphaned})
+				deleted[s.Name] = true
+			}
+			continue
+		}
+		var reasons []string
+		if s.Labels["env"] != st.Env {
+			reasons = append(reasons, envLabel(s.Labels, st.Env))
+		}
+		if s.AckDeadline != store.DefaultAckDeadline {
+			reasons = append(reasons, fmt.Sprintf("ack deadline %v", s.AckDeadline))
+		}
+		if len(reasons) > 0 {
+			changes = append(changes, Change{Action: Update, Subscription: s.Name, Reason: strings.Join(reasons, ", ")})
+		}
+	}
+	for _, name := range sortedKeys(subs) {
+		// subscriptions to another topic are recreated once deleted
+		if !current[name] || deleted[name] {
+			changes = append(changes, Change{Action: Create, Topic: subs[name], Subscription: name, Reason: "declared"})
+		}
+	}
+	return changes
+}
+
+// Orphans returns the subscriptions of services or topics no longer declared
+func Orphans(m *Manifest, st *State) []Change {
+	var out []Change
+	for _, c := range Plan(m, st, true) {
+		if c.Action == Delete && c.Subscription != "" {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Apply applies the changes, deletions first so a subscription can be
+// recreated for another topic
+func Apply(ctx context.Context, client *pubsub.Client, env string, changes []Change) error {
+	sorted := append([]Change(nil), changes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Action == Delete && sorted[j].Action != Delete
+	})
+	labels := map[string]string{"env": env}
+	for _, c := range sorted {
+		var err error
+		switch {
+		case c.Subscription == "" && c.Action == Create:
+			var t *pubsub.Topic
+			if t, err = client.CreateTopic(ctx, c.Topic); err == nil {
+				_, err = t.Update(ctx, pubsub.TopicConfigToUpdate{Labels: labels})
+			}
+		case c.Subscription == "" && c.Action == Update:
+			var cfg pubsub.TopicConfig
+			if cfg, err = client.Topic(c.Topic).Config(ctx); err == nil {
+				if cfg.Labels == nil {
+					cfg.Labels = make(map[string]string)
+				}
+				cfg.Labels["env"] = env
+				_, err = client.Topic(c.Topic).Update(ctx, pubsub.TopicConfigToUpdate{Labels: cfg.Labels})
+			}
+		case c.Subscription == "" && c.Action == Delete:
+			err = client.Topic(c.Topic).Delete(ctx)
+		case c.Action == Create:
+			_, err = client.CreateSubscription(ctx, c.Subscription, pubsub.SubscriptionConfig{
+				Topic:       client.Topic(c.Topic),
+				AckDeadline: store.DefaultAckDeadline,
+				Labels:      labels,
+			})
+		case c.Action == Update:
+			var cfg pubsub.SubscriptionConfig
+			if cfg, err = client.Subscription(c.Subscription).Config(ctx); err == nil {
+				if cfg.Labels == nil {
+					cfg.Labels = make(map[string]string)
+				}
+				cfg.Labels["env"] = env
+				_, err = client.Subscription(c.Subscription).Update(ctx, pubsub.SubscriptionConfigToUpdate{
+					AckDeadline: store.DefaultAckDeadline,
+					Labels:      cfg.Labels,
+				})
+			}
+		case c.Action == Delete:
+			err = client.Subscription(c.Subscription).Delete(ctx)
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %v", c, err)
+		}
+	}
+	return nil
+}
+
+// envLabel returns the mismatch of the env label
+func envLabel(labels map[string]string, env string) string {
+	v, ok := labels["env"]
+	if !ok {
+		return "env label missing"
+	}
+	return fmt.Sprintf("env label %q, expected %q", v, env)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
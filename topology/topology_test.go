@@ -0,0 +1,81 @@
+package topology
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aukbit/pluto-event-source/store"
+)
+
+func testState() *State {
+	env := map[string]string{"env": "dev"}
+	return &State{
+		Env: "dev",
+		Topics: []Topic{
+			{Name: "dev.order_created", Labels: env},
+			{Name: "dev.order_paid", Labels: map[string]string{"env": "prod"}},
+			{Name: "dev.order_shipped", Labels: env},
+		},
+		Subscriptions: []Subscription{
+			{Name: "dev.billing.order_created", Topic: "dev.order_created", AckDeadline: store.DefaultAckDeadline},
+			{Name: "dev.billing.order_paid", Topic: "dev.order_created", AckDeadline: store.DefaultAckDeadline, Labels: env},
+			{Name: "dev.shipping.order_shipped", Topic: "dev.order_shipped", AckDeadline: store.DefaultAckDeadline, Labels: env},
+			{Name: "dev.shipping.order_lost", AckDeadline: store.DefaultAckDeadline, Labels: env},
+		},
+	}
+}
+
+func testManifest() *Manifest {
+	return &Manifest{Services: map[string][]string{
+		"billing":  {"order_created", "order_paid"},
+		"shipping": {"order_lost"},
+	}}
+}
+
+func TestPlan(t *testing.T) {
+	want := []Change{
+		{Action: Update, Topic: "dev.order_paid", Reason: `env label "prod", expected "dev"`},
+		{Action: Create, Topic: "dev.order_lost", Reason: "declared"},
+		{Action: Update, Subscription: "dev.billing.order_created", Reason: "env label missing"},
+	}
+	if got := Plan(testManifest(), testState(), false); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected no deletion without prune\nwant %v\ngot  %v", want, got)
+	}
+	want = []Change{
+		{Action: Update, Topic: "dev.order_paid", Reason: `env label "prod", expected "dev"`},
+		{Action: Delete, Topic: "dev.order_shipped", Reason: "not declared"},
+		{Action: Create, Topic: "dev.order_lost", Reason: "declared"},
+		{Action: Update, Subscription: "dev.billing.order_created", Reason: "env label missing"},
+		{Action: Delete, Subscription: "dev.billing.order_paid", Reason: "subscribed to dev.order_created"},
+		{Action: Delete, Subscription: "dev.shipping.order_shipped", Reason: "orphaned, not declared"},
+		{Action: Delete, Subscription: "dev.shipping.order_lost", Reason: "orphaned, topic deleted"},
+		{Action: Create, Topic: "dev.order_paid", Subscription: "dev.billing.order_paid", Reason: "declared"},
+		{Action: Create, Topic: "dev.order_lost", Subscription: "dev.shipping.order_lost", Reason: "declared"},
+	}
+	if got := Plan(testManifest(), testState(), true); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected deletions with prune\nwant %v\ngot  %v", want, got)
+	}
+}
+
+func TestPlanCreate(t *testing.T) {
+	m := &Manifest{Services: map[string][]string{"billing": {"order_created"}}, Topics: []string{"audit"}}
+	want := []Change{
+		{Action: Create, Topic: "dev.audit", Reason: "declared"},
+		{Action: Create, Topic: "dev.order_created", Reason: "declared"},
+		{Action: Create, Topic: "dev.order_created", Subscription: "dev.billing.order_created", Reason: "declared"},
+	}
+	if got := Plan(m, &State{Env: "dev"}, false); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v\ngot  %v", want, got)
+	}
+}
+
+func TestOrphans(t *testing.T) {
+	var got []string
+	for _, c := range Orphans(testManifest(), testState()) {
+		got = append(got, c.Subscription)
+	}
+	want := []string{"dev.billing.order_paid", "dev.shipping.order_shipped", "dev.shipping.order_lost"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected orphans %v got %v", want, got)
+	}
+}